@@ -15,6 +15,8 @@ import (
 var (
 	endpoint string
 	nodeID   string
+	stateDir string
+	specPath string
 )
 
 func init() {
@@ -59,6 +61,33 @@ func main() {
 	runController.MarkPersistentFlagRequired("endpoint")
 	runCmd.AddCommand(runController)
 
+	stateCmd := &cobra.Command{
+		Use:   "state",
+		Short: "Prints the volumes mounted by the node service on this node, without their rclone config.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := rclone.DumpMountState(os.Stdout, stateDir); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+	stateCmd.PersistentFlags().StringVar(&stateDir, "state-dir", os.Getenv("STATE_DIR"), "state dir of the node service")
+	root.AddCommand(stateCmd)
+
+	mounterCmd := &cobra.Command{
+		Use:   "mounter",
+		Short: "Mounts a single volume in the foreground - started by the node service in a mounter pod.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := rclone.RunMounter(specPath); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		},
+	}
+	mounterCmd.PersistentFlags().StringVar(&specPath, "spec", "", "mount spec of the volume")
+	mounterCmd.MarkPersistentFlagRequired("spec")
+	root.AddCommand(mounterCmd)
+
 	versionCmd := &cobra.Command{
 		Use:   "version",
 		Short: "Prints information about this version of csi rclone plugin",
@@ -78,9 +107,12 @@ func main() {
 }
 
 func handleNode() {
-	err := unmountOldVols()
-	if err != nil {
-		klog.Warningf("There was an error when trying to unmount old volumes: %v", err)
+	// the mounts of mounter pods are still alive
+	if rclone.MounterImage() == "" {
+		err := unmountOldVols()
+		if err != nil {
+			klog.Warningf("There was an error when trying to unmount old volumes: %v", err)
+		}
 	}
 	d := rclone.NewDriver(nodeID, endpoint)
 	ns, err := rclone.NewNodeServer(d.CSIDriver)
@@ -96,15 +128,19 @@ func handleNode() {
 
 func handleController() {
 	d := rclone.NewDriver(nodeID, endpoint)
-	cs := rclone.NewControllerServer(d.CSIDriver)
+	cs, err := rclone.NewControllerServer(d.CSIDriver)
+	if err != nil {
+		panic(err)
+	}
 	d.WithControllerServer(cs)
-	err := d.Run()
+	err = d.Run()
 	if err != nil {
 		panic(err)
 	}
 }
 
-// unmountOldVols is used to unmount volumes after a restart on a node
+// unmountOldVols is used to unmount volumes after a restart on a node. Their mounts died with the rclone daemon
+// of the previous run, the node server mounts the volumes recorded in its mount state again.
 func unmountOldVols() error {
 	const mountType = "fuse.rclone"
 	const unmountTimeout = time.Second * 5
@@ -6,9 +6,9 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-var clientset *kubernetes.Clientset
+var clientset kubernetes.Interface
 
-func GetK8sClient() (*kubernetes.Clientset, error) {
+func GetK8sClient() (kubernetes.Interface, error) {
 	if clientset != nil {
 		return clientset, nil
 	}
@@ -17,13 +17,19 @@ func GetK8sClient() (*kubernetes.Clientset, error) {
 		return nil, err
 	}
 
-	clientset, err = kubernetes.NewForConfig(config)
+	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, err
 	}
+	clientset = client
 	return clientset, nil
 }
 
+// SetK8sClient replaces the client returned by GetK8sClient, e.g. with a fake client in tests
+func SetK8sClient(client kubernetes.Interface) {
+	clientset = client
+}
+
 func loadKubeConfig() (*rest.Config, error) {
 	//In Cluster Config
 	config, err := rest.InClusterConfig()
@@ -0,0 +1,22 @@
+package kube
+
+import (
+	"os"
+	"strings"
+)
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Namespace returns the namespace the driver is running in. It is taken from the NAMESPACE env var
+// and falls back to the namespace of the mounted service account, or "default" when running out of cluster.
+func Namespace() string {
+	if namespace := strings.TrimSpace(os.Getenv("NAMESPACE")); namespace != "" {
+		return namespace
+	}
+	if data, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+		if namespace := strings.TrimSpace(string(data)); namespace != "" {
+			return namespace
+		}
+	}
+	return "default"
+}
@@ -0,0 +1,22 @@
+// Package metrics serves the Prometheus metrics of the driver, which are registered with the default registry.
+
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+)
+
+// Serve starts serving the metrics on /metrics of addr in the background
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		klog.Infof("serving metrics on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			klog.Errorf("metrics server stopped: %v", err)
+		}
+	}()
+}
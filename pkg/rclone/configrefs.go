@@ -0,0 +1,96 @@
+// Config references track which mounts of the rclone daemon use the config of a volume. The config is created
+// by the first mount of the volume and only deleted when its last mount is gone, so that unmounting one target
+// path of a volume doesn't pull the credentials from under the others.
+
+package rclone
+
+import (
+	"strings"
+	"sync"
+)
+
+type configRefs struct {
+	mutex sync.Mutex
+	// mounts are the mount points using each config
+	mounts map[string]map[string]bool
+	// synced is set once the references were read from the mounts of the daemon
+	synced bool
+}
+
+func newConfigRefs() *configRefs {
+	return &configRefs{mounts: map[string]map[string]bool{}}
+}
+
+// sync records the mounts of the daemon, which still run after a restart of the node plugin or were created by
+// an earlier version without references
+func (c *configRefs) sync(mountPoints []MountPoint) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, mountPoint := range mountPoints {
+		configName, _, found := strings.Cut(mountPoint.Fs, ":")
+		if !found {
+			continue
+		}
+		c.addLocked(configName, mountPoint.MountPoint)
+	}
+	c.synced = true
+}
+
+func (c *configRefs) isSynced() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.synced
+}
+
+// reset forgets all references, e.g. when the daemon is restarted
+func (c *configRefs) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.mounts = map[string]map[string]bool{}
+	c.synced = false
+}
+
+// add records mountPoint as a user of configName, adding it again has no effect
+func (c *configRefs) add(configName, mountPoint string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.addLocked(configName, mountPoint)
+}
+
+func (c *configRefs) addLocked(configName, mountPoint string) {
+	if c.mounts[configName] == nil {
+		c.mounts[configName] = map[string]bool{}
+	}
+	c.mounts[configName][mountPoint] = true
+}
+
+// remove drops mountPoint from the users of configName and reports if the config is unused now
+func (c *configRefs) remove(configName, mountPoint string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.mounts[configName], mountPoint)
+	if len(c.mounts[configName]) > 0 {
+		return false
+	}
+	delete(c.mounts, configName)
+	return true
+}
+
+// nameOf returns the config used by the mount at mountPoint
+func (c *configRefs) nameOf(mountPoint string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for configName, mountPoints := range c.mounts {
+		if mountPoints[mountPoint] {
+			return configName, true
+		}
+	}
+	return "", false
+}
+
+// count is the number of mounts using configName
+func (c *configRefs) count(configName string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.mounts[configName])
+}
@@ -0,0 +1,51 @@
+package rclone
+
+import "testing"
+
+func TestConfigRefs(t *testing.T) {
+	refs := newConfigRefs()
+	if refs.isSynced() {
+		t.Fatal("new config references are synced")
+	}
+	refs.sync([]MountPoint{
+		{Fs: "pvc-1-0123abcd:bucket/pvc-1", MountPoint: "/staging/1"},
+		{Fs: "pvc-1-0123abcd:bucket/pvc-1", MountPoint: "/pods/a/mount"},
+		{Fs: "/local/path", MountPoint: "/staging/2"},
+	})
+	if !refs.isSynced() {
+		t.Fatal("config references are not synced after sync")
+	}
+	if count := refs.count("pvc-1-0123abcd"); count != 2 {
+		t.Errorf("count after sync = %d, want 2", count)
+	}
+	if name, ok := refs.nameOf("/staging/2"); ok {
+		t.Errorf("mount without config has config %q", name)
+	}
+
+	refs.add("pvc-1-0123abcd", "/pods/a/mount")
+	refs.add("pvc-2-4567cdef", "/staging/3")
+	if count := refs.count("pvc-1-0123abcd"); count != 2 {
+		t.Errorf("count after adding a mount again = %d, want 2", count)
+	}
+	if name, ok := refs.nameOf("/staging/3"); !ok || name != "pvc-2-4567cdef" {
+		t.Errorf("nameOf(/staging/3) = %q, %v, want pvc-2-4567cdef", name, ok)
+	}
+
+	if refs.remove("pvc-1-0123abcd", "/pods/a/mount") {
+		t.Error("config is reported unused while it is still mounted")
+	}
+	if !refs.remove("pvc-1-0123abcd", "/staging/1") {
+		t.Error("config is not reported unused after its last mount was removed")
+	}
+	if !refs.remove("pvc-3-89abcdef", "/staging/4") {
+		t.Error("unknown config is not reported unused")
+	}
+	if _, ok := refs.nameOf("/staging/1"); ok {
+		t.Error("removed mount still has a config")
+	}
+
+	refs.reset()
+	if refs.isSynced() || refs.count("pvc-2-4567cdef") != 0 {
+		t.Error("reset did not forget the references")
+	}
+}
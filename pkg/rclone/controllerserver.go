@@ -3,22 +3,67 @@
 package rclone
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog"
 
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/versioneer-tech/csi-rclone/pkg/kube"
+)
+
+const (
+	// provisioningModeSubdirectory provisions every volume into its own directory below the remotePath of the secret
+	provisioningModeSubdirectory = "subdirectory"
+
+	// remote reclaim policies decide what DeleteVolume does with the directory of a volume
+	reclaimPolicyRetain  = "retain"
+	reclaimPolicyPurge   = "purge"
+	reclaimPolicyArchive = "archive"
+
+	// archivePrefix is the directory below the remotePath that archived volumes are moved to
+	archivePrefix = ".deleted"
+	// archiveTimeFormat prefixes archived volume directories so that the retention sweep knows their age
+	archiveTimeFormat = "20060102T150405Z"
+
+	// snapshotPrefix is the directory below the remotePath that snapshots are copied to
+	snapshotPrefix = ".snapshots"
+
+	// unknownCapacity is reported for remotes without quota information, so that capacity-aware
+	// scheduling does not reject volumes on them
+	unknownCapacity = math.MaxInt64
+
+	// volumeProbeTimeout bounds the listing of a volume that reports its condition, volumeProbeConcurrency the
+	// volumes that ListVolumes probes at once
+	volumeProbeTimeout     = 10 * time.Second
+	volumeProbeConcurrency = 8
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
-	active_volumes map[string]int64
-	mutex          sync.RWMutex
+	RcloneOps  Operations
+	driverName string
+	volumes    *volumeRegistry
+	writers    *writerLeases
+	locks      *keyLocks
+	copies     *copyJobs
 }
 
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
@@ -30,11 +75,16 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities without capabilities")
 	}
 
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-	if _, ok := cs.active_volumes[volId]; !ok {
+	if err := cs.refreshVolumes(ctx); err != nil {
+		return nil, err
+	}
+	record, ok := cs.volumes.get(volId)
+	if !ok {
 		return nil, status.Errorf(codes.NotFound, "Volume %s not found", volId)
 	}
+	if err := validateVolumeCapabilities(req.GetVolumeCapabilities(), record.MultiWriter); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
 			VolumeContext:      req.VolumeContext,
@@ -44,19 +94,134 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}, nil
 }
 
+// refreshVolumes re-reads the volume registry before it is used by a request
+func (cs *controllerServer) refreshVolumes(ctx context.Context) error {
+	if err := cs.volumes.refresh(ctx); err != nil {
+		return status.Errorf(codes.Unavailable, "%v", err)
+	}
+	return nil
+}
+
+// registryError is the status of a request that could not write to the volume registry
+func registryError(err error, format string, args ...interface{}) error {
+	code := codes.Internal
+	if errors.Is(err, errRegistryFull) {
+		code = codes.ResourceExhausted
+	}
+	return status.Errorf(code, "%s: %v", fmt.Sprintf(format, args...), err)
+}
+
 // Attaching Volume
+// Nothing is attached, but publishing a volume for writing takes the writer lease of its remote path, so that
+// no second node or volume can write to the same path
 func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method ControllerPublishVolume not implemented")
+	klog.Infof("ControllerPublishVolume called for volume %s on node %s", req.GetVolumeId(), req.GetNodeId())
+	volId := req.GetVolumeId()
+	if len(volId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume must be provided volume id")
+	}
+	nodeId := req.GetNodeId()
+	if len(nodeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume must be provided node id")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume must be provided volume capability")
+	}
+
+	if err := cs.refreshVolumes(ctx); err != nil {
+		return nil, err
+	}
+	record, registered := cs.volumes.get(volId)
+	// multi-writer access is checked against allowMultiWriter of the StorageClass when the volume is created,
+	// statically provisioned volumes and volumes of earlier versions have no record of it
+	if err := validateVolumeCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}, true); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	path, err := cs.publishedPath(ctx, volId, record, registered)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getNode(ctx, nodeId); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "Node %s not found", nodeId)
+		}
+		return nil, status.Errorf(codes.Internal, "cannot read node %s: %v", nodeId, err)
+	}
+
+	if !req.GetReadonly() && isWriter(req.GetVolumeCapability()) {
+		if isSingleWriter(req.GetVolumeCapability()) {
+			err = cs.writers.acquire(ctx, path, nodeId, volId)
+		} else {
+			// writers on several nodes don't take the lease, but must not write next to a single writer
+			err = cs.writers.check(ctx, path, nodeId, volId)
+		}
+		if err != nil {
+			var conflict *errWriterConflict
+			if errors.As(err, &conflict) {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
+			return nil, status.Errorf(codes.Internal, "cannot acquire writer lease of volume %s: %v", volId, err)
+		}
+	}
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+// publishedPath identifies the remote path of a volume for its writer lease. Statically provisioned volumes are
+// resolved from their PV, volumes without a resolvable remote are only protected against themselves.
+func (cs *controllerServer) publishedPath(ctx context.Context, volId string, record volumeRecord, registered bool) (string, error) {
+	volume, err := cs.RcloneOps.GetVolumeById(ctx, volId)
+	if err != nil && err != ErrVolumeNotFound {
+		return "", status.Errorf(codes.Internal, "cannot read volume %s: %v", volId, err)
+	}
+	if err == ErrVolumeNotFound && !registered {
+		return "", status.Errorf(codes.NotFound, "Volume %s not found", volId)
+	}
+	if volume != nil && volume.Remote != "" {
+		return volume.Remote + ":" + volume.RemotePath, nil
+	}
+	if record.Remote != "" {
+		return record.Remote + ":" + withPathSuffix(record.RemotePath, record.RemotePathSuffix), nil
+	}
+	return "volume:" + volId, nil
+}
+
+// isWriter reports if the volume capability allows writing
+func isWriter(capability *csi.VolumeCapability) bool {
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return false
+	}
+	return true
+}
+
+// isSingleWriter reports if the volume capability allows writing from a single node only
+func isSingleWriter(capability *csi.VolumeCapability) bool {
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER:
+		return true
+	}
+	return false
 }
 
 // Detaching Volume
 func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method ControllerUnpublishVolume not implemented")
+	klog.Infof("ControllerUnpublishVolume called for volume %s on node %s", req.GetVolumeId(), req.GetNodeId())
+	volId := req.GetVolumeId()
+	if len(volId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume must be provided volume id")
+	}
+	// without a node id the volume is unpublished from all nodes
+	nodeId := req.GetNodeId()
+	if err := cs.writers.release(ctx, nodeId, volId); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot release writer lease of volume %s: %v", volId, err)
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
 // Provisioning Volumes
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	klog.Infof("CreateVolumeRequest=%+v", *req)
+	// the request is not logged as a whole, its secrets contain the credentials of the remote
+	klog.Infof("CreateVolume called for %s with parameters %v", req.GetName(), req.GetParameters())
 	volumeName := req.GetName()
 	if len(volumeName) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume name must be provided")
@@ -65,17 +230,35 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if len(req.GetVolumeCapabilities()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume without capabilities")
 	}
+	allowMultiWriter := false
+	if value, ok := req.Parameters["allowMultiWriter"]; ok {
+		var err error
+		if allowMultiWriter, err = strconv.ParseBool(value); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot parse allowMultiWriter: %v", err)
+		}
+	}
+	if err := validateVolumeCapabilities(req.GetVolumeCapabilities(), allowMultiWriter); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	multiWriter := false
+	for _, capability := range req.GetVolumeCapabilities() {
+		if capability.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+			multiWriter = true
+		}
+	}
 
-	// we don't use the size as it makes no sense for rclone. but csi drivers should succeed if
+	// the size is only reported as the size of the mounted filesystem. but csi drivers should succeed if
 	// called twice with the same capacity for the same volume and fail if called twice with
 	// differing capacity, so we need to remember it
 	volSizeBytes := int64(req.GetCapacityRange().GetRequiredBytes())
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-	if val, ok := cs.active_volumes[volumeName]; ok && val != volSizeBytes {
+	unlock := cs.locks.lock(volumeKey(volumeName))
+	defer unlock()
+	if err := cs.refreshVolumes(ctx); err != nil {
+		return nil, err
+	}
+	if val, ok := cs.volumes.get(volumeName); ok && val.CapacityBytes != volSizeBytes {
 		return nil, status.Errorf(codes.AlreadyExists, "Volume operation already exists for volume %s", volumeName)
 	}
-	cs.active_volumes[volumeName] = volSizeBytes
 
 	// See https://github.com/kubernetes-csi/external-provisioner/blob/v5.1.0/pkg/controller/controller.go#L75
 	// on how parameters from the persistent volume are parsed
@@ -88,6 +271,13 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.FailedPrecondition, "The PVC name and/or namespace are not present in the create volume request parameters.")
 	}
 	volumeContext := map[string]string{}
+	record := volumeRecord{
+		CapacityBytes:   volSizeBytes,
+		SecretName:      pvcName,
+		SecretNamespace: pvcNamespace,
+		MultiWriter:     multiWriter,
+	}
+	record.ProvisionerSecretNamespace, record.ProvisionerSecretName = provisionerSecretRef(ctx, volumeName, pvcNamespace, pvcName)
 
 	secretName, ok := req.Parameters["csi.storage.k8s.io/node-publish-secret-name"]
 	if !ok || strings.TrimSpace(secretName) == "" {
@@ -99,45 +289,1003 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		volumeContext["secretNamespace"] = pvcNamespace
 	}
 
-	if vfsOpt, ok := req.Parameters["vfsOpt"]; ok && strings.TrimSpace(vfsOpt) != "" {
-		volumeContext["vfsOpt"] = vfsOpt
+	// invalid mount options would only be noticed when the volume is mounted, so that the pod would be
+	// stuck with a PV that can never be mounted
+	for _, key := range []string{"vfsOpt", "mountOpt"} {
+		if value, ok := req.Parameters[key]; ok && strings.TrimSpace(value) != "" {
+			if err := validateMountOption(key, value); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid StorageClass parameter: %v", err)
+			}
+			volumeContext[key] = value
+		}
+	}
+	// the parameters of a VolumeAttributesClass the PVC is created with apply on top of the StorageClass, as if the
+	// volume was modified right away
+	if err := validateMutableParameters(req.GetMutableParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid VolumeAttributesClass parameter: %v", err)
 	}
-	if mountOpt, ok := req.Parameters["mountOpt"]; ok && strings.TrimSpace(mountOpt) != "" {
-		volumeContext["mountOpt"] = mountOpt
+	parameters := map[string]string{}
+	for key, value := range req.Parameters {
+		parameters[key] = value
+	}
+	if len(req.GetMutableParameters()) > 0 {
+		record.MutableParameters = map[string]string{}
+		for key, value := range req.GetMutableParameters() {
+			record.MutableParameters[key] = value
+			volumeContext[modifiedParameterPrefix+key] = value
+			parameters[modifiedParameterPrefix+key] = value
+		}
+	}
+	if multiWriter {
+		if err := validateMultiWriterParameters(parameters); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid StorageClass or VolumeAttributesClass parameter: %v", err)
+		}
+	}
+	if volSizeBytes > 0 {
+		volumeContext["capacityBytes"] = strconv.FormatInt(volSizeBytes, 10)
+	}
+
+	reclaimPolicy, archiveRetention, err := parseReclaimParameters(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	record.AccessibleTopology = accessibleTopology(req.GetAccessibilityRequirements())
+
+	var source *contentSource
+	if req.GetVolumeContentSource() != nil {
+		if req.Parameters["provisioningMode"] != provisioningModeSubdirectory {
+			return nil, status.Error(codes.InvalidArgument, "volumes with a content source require provisioningMode subdirectory")
+		}
+		if source, err = cs.resolveContentSource(ctx, req.GetVolumeContentSource(), req.GetSecrets()); err != nil {
+			return nil, err
+		}
+	}
+
+	remote, remotePath, configData, err := resolveRemoteConfig(ctx, req.GetSecrets(), pvcNamespace, pvcName)
+	if err != nil {
+		return nil, err
+	}
+	// only volumes with their own directory need the remote on the controller, others may get it from a node
+	// publish secret that the controller doesn't see, so only what it can resolve is checked for them
+	if req.Parameters["provisioningMode"] == provisioningModeSubdirectory {
+		if err := validateRemoteConfig(remote, configData); err != nil {
+			if len(req.GetSecrets()) == 0 && remote == "" && configData == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "no provisioner secret configured and secret %s/%s does not exist or is empty", pvcNamespace, pvcName)
+			}
+			return nil, status.Errorf(codes.InvalidArgument, "invalid remote configuration in provisioner secret or secret %s/%s: %v", pvcNamespace, pvcName, err)
+		}
+	} else if configData != "" {
+		if _, err := parseConfigData(configData); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid configData in provisioner secret or secret %s/%s: %v", pvcNamespace, pvcName, err)
+		}
+	}
+
+	if req.Parameters["provisioningMode"] == provisioningModeSubdirectory {
+		if err := cs.createVolumeDirectory(ctx, volumeName, remote, remotePath, configData, source); err != nil {
+			return nil, err
+		}
+		record.Remote = remote
+		record.RemotePath = remotePath
+		record.RemotePathSuffix = "/" + volumeName
+		record.ReclaimPolicy = reclaimPolicy
+		record.ArchiveRetention = archiveRetention
+		volumeContext["remotePathSuffix"] = record.RemotePathSuffix
+	} else if reclaimPolicy != reclaimPolicyRetain {
+		return nil, status.Errorf(codes.InvalidArgument, "remoteReclaimPolicy %s requires provisioningMode subdirectory", reclaimPolicy)
+	}
+
+	if err := cs.volumes.put(ctx, volumeName, record); err != nil {
+		return nil, registryError(err, "cannot register volume %s", volumeName)
 	}
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      volumeName,
-			VolumeContext: volumeContext,
+			VolumeId:           volumeName,
+			CapacityBytes:      volSizeBytes,
+			VolumeContext:      volumeContext,
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: toCSITopology(record.AccessibleTopology),
 		},
 	}, nil
 
 }
 
+// provisionerSecretRef returns the namespace and name of the provisioner secret of the StorageClass of the PVC.
+// The external-provisioner removes them from the parameters, so they are read from the StorageClass itself.
+// Secrets named with a template that can't be resolved here are not returned.
+func provisionerSecretRef(ctx context.Context, volumeName, pvcNamespace, pvcName string) (string, string) {
+	pvc, err := getPVC(ctx, pvcNamespace, pvcName)
+	if err != nil || pvc.Spec.StorageClassName == nil {
+		klog.Warningf("cannot read the StorageClass of PVC %s/%s: %v", pvcNamespace, pvcName, err)
+		return "", ""
+	}
+	storageClass, err := getStorageClass(ctx, *pvc.Spec.StorageClassName)
+	if err != nil {
+		klog.Warningf("cannot read StorageClass %s: %v", *pvc.Spec.StorageClassName, err)
+		return "", ""
+	}
+	templates := strings.NewReplacer("${pv.name}", volumeName, "${pvc.namespace}", pvcNamespace, "${pvc.name}", pvcName)
+	namespace := templates.Replace(storageClass.Parameters["csi.storage.k8s.io/provisioner-secret-namespace"])
+	name := templates.Replace(storageClass.Parameters["csi.storage.k8s.io/provisioner-secret-name"])
+	if namespace == "" || name == "" || strings.Contains(namespace+name, "${") {
+		return "", ""
+	}
+	return namespace, name
+}
+
+// validateVolumeCapabilities accepts mounted volumes with single node, read-only and, if allowed by the
+// StorageClass, multi-writer access
+func validateVolumeCapabilities(capabilities []*csi.VolumeCapability, allowMultiWriter bool) error {
+	for _, capability := range capabilities {
+		if capability.GetBlock() != nil {
+			return errors.New("block volumes are not supported")
+		}
+		switch mode := capability.GetAccessMode().GetMode(); mode {
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+			if !allowMultiWriter {
+				return fmt.Errorf("access mode %s requires the StorageClass parameter allowMultiWriter: \"true\"", mode)
+			}
+		default:
+			return fmt.Errorf("access mode %s is not supported", mode)
+		}
+	}
+	return nil
+}
+
+// validateMultiWriterParameters checks that the mount parameters are safe for writers on several nodes
+func validateMultiWriterParameters(parameters map[string]string) error {
+	vfsOpt, mountOpt, err := mountOptions(parameters, false)
+	if err != nil {
+		return err
+	}
+	return validateMultiWriter(vfsOpt, mountOpt)
+}
+
+// accessibleTopology constrains a volume to the requisite segments of the topology key. These are the
+// allowedTopologies of the StorageClass, or all segments of the cluster if it does not restrict them.
+// Preferred segments are used if there are no requisite ones.
+func accessibleTopology(requirements *csi.TopologyRequirement) []map[string]string {
+	key := topologyKey()
+	if key == "" || requirements == nil {
+		return nil
+	}
+	topologies := requirements.GetRequisite()
+	if len(topologies) == 0 {
+		topologies = requirements.GetPreferred()
+	}
+	segments := []map[string]string{}
+	seen := map[string]bool{}
+	for _, topology := range topologies {
+		value, ok := topology.GetSegments()[key]
+		if !ok || seen[value] {
+			continue
+		}
+		seen[value] = true
+		segments = append(segments, map[string]string{key: value})
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	return segments
+}
+
+func toCSITopology(segments []map[string]string) []*csi.Topology {
+	if len(segments) == 0 {
+		return nil
+	}
+	topologies := make([]*csi.Topology, 0, len(segments))
+	for _, segment := range segments {
+		topologies = append(topologies, &csi.Topology{Segments: segment})
+	}
+	return topologies
+}
+
+// contentSource is the remote location the content of a new volume is copied from
+type contentSource struct {
+	volume     *RcloneVolume
+	configData string
+	excludes   []string
+}
+
+func (cs *controllerServer) resolveContentSource(ctx context.Context, source *csi.VolumeContentSource, secrets map[string]string) (*contentSource, error) {
+	if snapshotId := source.GetSnapshot().GetSnapshotId(); snapshotId != "" {
+		snapshot, ok := cs.volumes.getSnapshot(snapshotId)
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "Snapshot %s not found", snapshotId)
+		}
+		if snapshot.Pending {
+			return nil, status.Errorf(codes.Unavailable, "Snapshot %s is not ready to use yet", snapshotId)
+		}
+		_, _, configData, err := resolveRemoteConfig(ctx, secrets, snapshot.SecretNamespace, snapshot.SecretName)
+		if err != nil {
+			return nil, err
+		}
+		if configData == "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "cannot restore snapshot %s: no secret with configData found", snapshotId)
+		}
+		return &contentSource{
+			volume:     &RcloneVolume{Remote: snapshot.Remote, RemotePath: snapshot.RemotePath},
+			configData: configData,
+		}, nil
+	}
+	if volId := source.GetVolume().GetVolumeId(); volId != "" {
+		record, ok := cs.volumes.get(volId)
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "Volume %s not found", volId)
+		}
+		location, err := cs.locateVolume(ctx, volId, record, secrets)
+		if err != nil {
+			return nil, err
+		}
+		return &contentSource{
+			volume:     &RcloneVolume{ID: volId, Remote: location.remote, RemotePath: location.volumePath},
+			configData: location.configData,
+			excludes:   []string{"/" + snapshotPrefix + "/**", "/" + archivePrefix + "/**"},
+		}, nil
+	}
+	return nil, status.Error(codes.InvalidArgument, "unsupported volume content source")
+}
+
+// createVolumeDirectory creates the directory of the volume. The content of a source is copied in the background,
+// until it is done the volume is reported as aborted, so that the provisioner repeats the request.
+func (cs *controllerServer) createVolumeDirectory(ctx context.Context, volumeName, remote, remotePath, configData string, source *contentSource) error {
+	if source == nil {
+		if err := cs.copyVolumeContent(ctx, volumeName, remote, remotePath, configData, nil); err != nil {
+			return status.Errorf(codes.Internal, "cannot create directory for volume %s: %v", volumeName, err)
+		}
+		return nil
+	}
+	done, err := cs.copies.poll(volumeKey(volumeName), func(ctx context.Context) error {
+		return cs.copyVolumeContent(ctx, volumeName, remote, remotePath, configData, source)
+	})
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot copy content into volume %s: %v", volumeName, err)
+	}
+	if !done {
+		return status.Errorf(codes.Aborted, "content of volume %s is still being copied", volumeName)
+	}
+	return nil
+}
+
+func (cs *controllerServer) copyVolumeContent(ctx context.Context, volumeName, remote, remotePath, configData string, source *contentSource) error {
+	// a source on another remote needs its section in the config as well, a remote of the same name is
+	// expected to be the same remote and only configured once
+	if source != nil && source.volume.Remote != remote {
+		configData = configData + "\n" + source.configData
+	}
+	configPath, cleanup, err := writeRcloneConfig(configData)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err := cs.RcloneOps.CreateVol(ctx, volumeName, remote, remotePath, configPath, nil); err != nil {
+		return err
+	}
+	if source == nil {
+		return nil
+	}
+	target := &RcloneVolume{ID: volumeName, Remote: remote, RemotePath: joinRemotePath(remotePath, volumeName)}
+	klog.Infof("copying %s:%s into volume %s", source.volume.Remote, source.volume.RemotePath, volumeName)
+	if err := cs.RcloneOps.CopyVol(ctx, source.volume, target, configPath, source.excludes...); err != nil {
+		return err
+	}
+	klog.Infof("content of volume %s is copied", volumeName)
+	return nil
+}
+
+// resolveRemoteConfig resolves the rclone remote for remote-side operations on the controller. The provisioner
+// secret of the request is the default and, like on the node, gets overridden by the secret named after the PVC.
+func resolveRemoteConfig(ctx context.Context, secrets map[string]string, secretNamespace, secretName string) (string, string, string, error) {
+	var pvcSecret *v1.Secret
+	if secretNamespace != "" && secretName != "" {
+		var err error
+		pvcSecret, err = getSecret(ctx, secretNamespace, secretName)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", "", "", status.Errorf(codes.Internal, "cannot read secret %s/%s: %v", secretNamespace, secretName, err)
+		}
+	}
+	remote, remotePath, configData, _, err := extractFlags(nil, secrets, pvcSecret)
+	return remote, remotePath, configData, err
+}
+
+// validateRemoteConfig checks that the merged secrets of a volume contain everything needed to mount it
+func validateRemoteConfig(remote, configData string) error {
+	if strings.TrimSpace(remote) == "" {
+		return errors.New("remote is missing")
+	}
+	if strings.TrimSpace(configData) == "" {
+		return errors.New("configData is missing")
+	}
+	if _, err := parseConfigData(configData); err != nil {
+		return fmt.Errorf("cannot parse configData: %w", err)
+	}
+	return nil
+}
+
+// writeRcloneConfig stores configData in a private temporary rclone config for remote-side operations.
+// The returned cleanup function removes it again.
+func writeRcloneConfig(configData string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "csi-rclone-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			klog.Warningf("cannot remove temporary rclone config %s: %v", dir, err)
+		}
+	}
+	configPath := filepath.Join(dir, "rclone.conf")
+	if err = os.WriteFile(configPath, []byte(configData), 0600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return configPath, cleanup, nil
+}
+
+func parseReclaimParameters(parameters map[string]string) (string, string, error) {
+	reclaimPolicy := strings.TrimSpace(parameters["remoteReclaimPolicy"])
+	switch reclaimPolicy {
+	case "":
+		reclaimPolicy = reclaimPolicyRetain
+	case reclaimPolicyRetain, reclaimPolicyPurge, reclaimPolicyArchive:
+	default:
+		return "", "", status.Errorf(codes.InvalidArgument, "unknown remoteReclaimPolicy %q, expected one of %s, %s or %s",
+			reclaimPolicy, reclaimPolicyRetain, reclaimPolicyPurge, reclaimPolicyArchive)
+	}
+
+	archiveRetention := strings.TrimSpace(parameters["archiveRetention"])
+	if archiveRetention != "" {
+		if reclaimPolicy != reclaimPolicyArchive {
+			return "", "", status.Error(codes.InvalidArgument, "archiveRetention can only be used with remoteReclaimPolicy archive")
+		}
+		if _, err := time.ParseDuration(archiveRetention); err != nil {
+			return "", "", status.Errorf(codes.InvalidArgument, "cannot parse archiveRetention: %v", err)
+		}
+	}
+	return reclaimPolicy, archiveRetention, nil
+}
+
 // Delete Volume
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	volId := req.GetVolumeId()
 	if len(volId) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "DeteleVolume must be provided volume id")
 	}
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-	delete(cs.active_volumes, volId)
+	unlock := cs.locks.lock(volumeKey(volId))
+	defer unlock()
+	cs.copies.cancel(volumeKey(volId))
+	if err := cs.refreshVolumes(ctx); err != nil {
+		return nil, err
+	}
+	if record, ok := cs.volumes.get(volId); ok {
+		if err := cs.reclaimVolumeData(ctx, volId, record, req.GetSecrets()); err != nil {
+			return nil, err
+		}
+	}
+	if err := cs.volumes.remove(ctx, volId); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot unregister volume %s: %v", volId, err)
+	}
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-func (*controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method ControllerExpandVolume not implemented")
+// reclaimVolumeData applies the remote reclaim policy of the volume to its directory on the remote
+func (cs *controllerServer) reclaimVolumeData(ctx context.Context, volId string, record volumeRecord, secrets map[string]string) error {
+	if record.RemotePathSuffix == "" || record.ReclaimPolicy == "" || record.ReclaimPolicy == reclaimPolicyRetain {
+		return nil
+	}
+	_, _, configData, err := resolveRemoteConfig(ctx, secrets, record.SecretNamespace, record.SecretName)
+	if err != nil {
+		return err
+	}
+	if configData == "" {
+		return status.Errorf(codes.FailedPrecondition, "cannot %s volume %s without a provisioner secret or secret %s/%s containing configData",
+			record.ReclaimPolicy, volId, record.SecretNamespace, record.SecretName)
+	}
+	configPath, cleanup, err := writeRcloneConfig(configData)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot write rclone config: %v", err)
+	}
+	defer cleanup()
+
+	rcloneVol := &RcloneVolume{
+		ID:         volId,
+		Remote:     record.Remote,
+		RemotePath: withPathSuffix(record.RemotePath, record.RemotePathSuffix),
+	}
+	switch record.ReclaimPolicy {
+	case reclaimPolicyPurge:
+		klog.Infof("purging remote data of volume %s at %s:%s", volId, rcloneVol.Remote, rcloneVol.RemotePath)
+		err = cs.RcloneOps.DeleteVol(ctx, rcloneVol, configPath, nil)
+	case reclaimPolicyArchive:
+		archiveName := fmt.Sprintf("%s-%s", time.Now().UTC().Format(archiveTimeFormat), volId)
+		archivePath := joinRemotePath(record.RemotePath, archivePrefix+"/"+archiveName)
+		klog.Infof("archiving remote data of volume %s to %s:%s", volId, rcloneVol.Remote, archivePath)
+		err = cs.RcloneOps.MoveVol(ctx, rcloneVol, archivePath, configPath)
+	}
+	if err != nil && !isDirNotFound(err) {
+		return status.Errorf(codes.Internal, "cannot %s remote data of volume %s: %v", record.ReclaimPolicy, volId, err)
+	}
+
+	if record.ReclaimPolicy == reclaimPolicyArchive && record.ArchiveRetention != "" {
+		cs.sweepArchive(ctx, record, configPath)
+	}
+	return nil
+}
+
+// sweepArchive purges archived volumes below the remotePath of record that are older than its retention.
+// Failures are only logged, the sweep is repeated on the next archiving DeleteVolume anyway.
+func (cs *controllerServer) sweepArchive(ctx context.Context, record volumeRecord, configPath string) {
+	retention, err := time.ParseDuration(record.ArchiveRetention)
+	if err != nil {
+		klog.Warningf("invalid archiveRetention %q: %v", record.ArchiveRetention, err)
+		return
+	}
+	archiveRoot := joinRemotePath(record.RemotePath, archivePrefix)
+	dirs, err := cs.RcloneOps.ListDirs(ctx, record.Remote, archiveRoot, configPath)
+	if err != nil {
+		klog.Warningf("cannot list archived volumes in %s:%s: %v", record.Remote, archiveRoot, err)
+		return
+	}
+	for _, dir := range dirs {
+		timestamp, _, found := strings.Cut(dir, "-")
+		if !found {
+			continue
+		}
+		archivedAt, err := time.Parse(archiveTimeFormat, timestamp)
+		if err != nil || time.Since(archivedAt) < retention {
+			continue
+		}
+		archived := &RcloneVolume{Remote: record.Remote, RemotePath: joinRemotePath(archiveRoot, dir)}
+		klog.Infof("purging archived volume %s:%s", archived.Remote, archived.RemotePath)
+		if err := cs.RcloneOps.DeleteVol(ctx, archived, configPath, nil); err != nil && !isDirNotFound(err) {
+			klog.Warningf("cannot purge archived volume %s:%s: %v", archived.Remote, archived.RemotePath, err)
+		}
+	}
 }
 
+// Resizing Volume only changes the size reported by the mounted filesystem, which the node picks up when it stages
+// the volume the next time (NodeStageVolume)
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	volId := req.GetVolumeId()
+	if len(volId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume must be provided volume id")
+	}
+	if req.GetCapacityRange() == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume must be provided capacity range")
+	}
+	capacity := req.GetCapacityRange().GetRequiredBytes()
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && capacity > limit {
+		return nil, status.Errorf(codes.OutOfRange, "required bytes %d exceed limit bytes %d", capacity, limit)
+	}
+
+	unlock := cs.locks.lock(volumeKey(volId))
+	defer unlock()
+	if err := cs.refreshVolumes(ctx); err != nil {
+		return nil, err
+	}
+	record, ok := cs.volumes.get(volId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Volume %s not found", volId)
+	}
+	if capacity > record.CapacityBytes {
+		record.CapacityBytes = capacity
+		if err := cs.volumes.put(ctx, volId, record); err != nil {
+			return nil, registryError(err, "cannot update volume %s", volId)
+		}
+	}
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         record.CapacityBytes,
+		NodeExpansionRequired: true,
+	}, nil
+}
+
+// ControllerGetVolume reports the volume as abnormal if it can't be listed on the remote with its credentials
 func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return &csi.ControllerGetVolumeResponse{Volume: &csi.Volume{
-		VolumeId: req.VolumeId,
-	}}, nil
+	volId := req.GetVolumeId()
+	if len(volId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume must be provided volume id")
+	}
+	if err := cs.refreshVolumes(ctx); err != nil {
+		return nil, err
+	}
+	record, ok := cs.volumes.get(volId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Volume %s not found", volId)
+	}
+	publishedNodes, err := cs.publishedNodes(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list published nodes: %v", err)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:           volId,
+			CapacityBytes:      record.CapacityBytes,
+			AccessibleTopology: toCSITopology(record.AccessibleTopology),
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodes[volId],
+			VolumeCondition:  cs.probeVolume(ctx, volId, record),
+		},
+	}, nil
 }
 
+// probeVolume reports the volume as abnormal unless its directory can be listed on the remote within
+// volumeProbeTimeout
+func (cs *controllerServer) probeVolume(ctx context.Context, volId string, record volumeRecord) *csi.VolumeCondition {
+	ctx, cancel := context.WithTimeout(ctx, volumeProbeTimeout)
+	defer cancel()
+	secrets := map[string]string{}
+	if record.ProvisionerSecretName != "" {
+		secret, err := getSecret(ctx, record.ProvisionerSecretNamespace, record.ProvisionerSecretName)
+		if err != nil {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("cannot read provisioner secret %s/%s: %v",
+				record.ProvisionerSecretNamespace, record.ProvisionerSecretName, err)}
+		}
+		for key, value := range secret.Data {
+			secrets[key] = string(value)
+		}
+	}
+	location, err := cs.locateVolume(ctx, volId, record, secrets)
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: status.Convert(err).Message()}
+	}
+	configPath, cleanup, err := writeRcloneConfig(location.configData)
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("cannot write rclone config: %v", err)}
+	}
+	defer cleanup()
+	rcloneVol := &RcloneVolume{ID: volId, Remote: location.remote, RemotePath: location.volumePath}
+	if err := cs.RcloneOps.Probe(ctx, rcloneVol, configPath); err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("cannot list %s:%s: %v", location.remote, location.volumePath, err)}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is reachable on the remote"}
+}
+
+// ControllerModifyVolume changes the vfsOpt and mountOpt of a volume, e.g. from a VolumeAttributesClass. They are
+// applied on top of the StorageClass parameters when a node stages the volume the next time (NodeStageVolume).
 func (cs *controllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	volId := req.GetVolumeId()
+	if len(volId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerModifyVolume must be provided volume id")
+	}
+	if err := validateMutableParameters(req.GetMutableParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	unlock := cs.locks.lock(volumeKey(volId))
+	defer unlock()
+	if err := cs.refreshVolumes(ctx); err != nil {
+		return nil, err
+	}
+	record, ok := cs.volumes.get(volId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Volume %s not found", volId)
+	}
+	if len(req.GetMutableParameters()) == 0 {
+		return &csi.ControllerModifyVolumeResponse{}, nil
+	}
+	if record.MultiWriter {
+		modified := map[string]string{}
+		for key, value := range record.MutableParameters {
+			modified[modifiedParameterPrefix+key] = value
+		}
+		for key, value := range req.GetMutableParameters() {
+			modified[modifiedParameterPrefix+key] = value
+		}
+		if err := validateMultiWriterParameters(modified); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if record.MutableParameters == nil {
+		record.MutableParameters = map[string]string{}
+	}
+	for key, value := range req.GetMutableParameters() {
+		record.MutableParameters[key] = value
+	}
+	if err := annotateMutableParameters(ctx, volId, record.MutableParameters); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot annotate PV %s: %v", volId, err)
+	}
+	if err := cs.volumes.put(ctx, volId, record); err != nil {
+		return nil, registryError(err, "cannot update volume %s", volId)
+	}
+	klog.Infof("modified parameters of volume %s, they are applied when the volume is staged the next time", volId)
 	return &csi.ControllerModifyVolumeResponse{}, nil
 }
+
+// validateMutableParameters checks the parameters of a VolumeAttributesClass, only vfsOpt and mountOpt are mutable
+func validateMutableParameters(parameters map[string]string) error {
+	for key, value := range parameters {
+		if key != "vfsOpt" && key != "mountOpt" {
+			return fmt.Errorf("parameter %s can't be modified, only vfsOpt and mountOpt are mutable", key)
+		}
+		if err := validateMountOption(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// annotateMutableParameters stores the modified parameters on the PV, where the node picks them up on publish
+func annotateMutableParameters(ctx context.Context, volId string, parameters map[string]string) error {
+	kubeClient, err := kube.GetK8sClient()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(parameters)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{mutableParametersAnnotation(): string(data)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = kubeClient.CoreV1().PersistentVolumes().Patch(ctx, volId, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// volumeLocation is where a registered volume lives on the remote together with the rclone config to reach it
+type volumeLocation struct {
+	remote     string
+	basePath   string
+	volumePath string
+	configData string
+}
+
+func (cs *controllerServer) locateVolume(ctx context.Context, volId string, record volumeRecord, secrets map[string]string) (*volumeLocation, error) {
+	remote, basePath, configData, err := resolveRemoteConfig(ctx, secrets, record.SecretNamespace, record.SecretName)
+	if err != nil {
+		return nil, err
+	}
+	if record.Remote != "" {
+		remote = record.Remote
+		basePath = record.RemotePath
+	}
+	if remote == "" || configData == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot resolve remote of volume %s: no secret with remote and configData found", volId)
+	}
+	volumePath := withPathSuffix(basePath, record.RemotePathSuffix)
+	return &volumeLocation{
+		remote:     remote,
+		basePath:   basePath,
+		volumePath: volumePath,
+		configData: configData,
+	}, nil
+}
+
+// Snapshots are copies of the volume directory below the snapshot prefix of the remotePath
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	klog.Infof("CreateSnapshot called for snapshot %s of volume %s", req.GetName(), req.GetSourceVolumeId())
+	snapshotName := req.GetName()
+	if len(snapshotName) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot name must be provided")
+	}
+	volId := req.GetSourceVolumeId()
+	if len(volId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot source volume id must be provided")
+	}
+
+	unlock := cs.locks.lock(snapshotKey(snapshotName))
+	defer unlock()
+	if err := cs.refreshVolumes(ctx); err != nil {
+		return nil, err
+	}
+	snapshot, ok := cs.volumes.getSnapshot(snapshotName)
+	if ok {
+		if snapshot.SourceVolumeID != volId {
+			return nil, status.Errorf(codes.AlreadyExists, "Snapshot %s already exists for volume %s", snapshotName, snapshot.SourceVolumeID)
+		}
+		if !snapshot.Pending {
+			return &csi.CreateSnapshotResponse{Snapshot: newCSISnapshot(snapshotName, snapshot)}, nil
+		}
+	}
+	record, found := cs.volumes.get(volId)
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "Volume %s not found", volId)
+	}
+	location, err := cs.locateVolume(ctx, volId, record, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// the snapshot is registered before its data is copied, so that it can be listed and deleted meanwhile
+		snapshot = snapshotRecord{
+			SourceVolumeID:  volId,
+			Remote:          location.remote,
+			RemotePath:      joinRemotePath(location.basePath, snapshotPrefix+"/"+snapshotName),
+			SecretName:      record.SecretName,
+			SecretNamespace: record.SecretNamespace,
+			CreationTime:    time.Now().UnixNano(),
+			Pending:         true,
+		}
+		if err := cs.volumes.putSnapshot(ctx, snapshotName, snapshot); err != nil {
+			return nil, registryError(err, "cannot register snapshot %s", snapshotName)
+		}
+	}
+
+	done, err := cs.copies.poll(snapshotKey(snapshotName), func(ctx context.Context) error {
+		return cs.copySnapshot(ctx, snapshotName, snapshot, location)
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot copy volume %s to snapshot %s: %v", volId, snapshotName, err)
+	}
+	if done {
+		if snapshot, ok = cs.volumes.getSnapshot(snapshotName); !ok {
+			return nil, status.Errorf(codes.Aborted, "Snapshot %s was deleted while it was created", snapshotName)
+		}
+	}
+	return &csi.CreateSnapshotResponse{Snapshot: newCSISnapshot(snapshotName, snapshot)}, nil
+}
+
+// copySnapshot copies the source volume into the snapshot and marks the snapshot as ready to use
+func (cs *controllerServer) copySnapshot(ctx context.Context, snapshotName string, snapshot snapshotRecord, location *volumeLocation) error {
+	configPath, cleanup, err := writeRcloneConfig(location.configData)
+	if err != nil {
+		return fmt.Errorf("cannot write rclone config: %w", err)
+	}
+	defer cleanup()
+
+	source := &RcloneVolume{ID: snapshot.SourceVolumeID, Remote: location.remote, RemotePath: location.volumePath}
+	klog.Infof("copying volume %s to snapshot %s:%s", snapshot.SourceVolumeID, snapshot.Remote, snapshot.RemotePath)
+	// volumes without their own directory contain the snapshot and archive directories themselves
+	target := &RcloneVolume{Remote: snapshot.Remote, RemotePath: snapshot.RemotePath}
+	err = cs.RcloneOps.CopyVol(ctx, source, target, configPath, "/"+snapshotPrefix+"/**", "/"+archivePrefix+"/**")
+	if err != nil {
+		return err
+	}
+	if size, err := cs.RcloneOps.Size(ctx, target, configPath); err == nil {
+		snapshot.SizeBytes = size
+	} else {
+		klog.Warningf("cannot determine size of snapshot %s: %v", snapshotName, err)
+	}
+
+	unlock := cs.locks.lock(snapshotKey(snapshotName))
+	defer unlock()
+	// DeleteSnapshot cancels the copy before it unregisters the snapshot
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	snapshot.Pending = false
+	if err := cs.volumes.putSnapshot(ctx, snapshotName, snapshot); err != nil {
+		return fmt.Errorf("cannot register snapshot %s: %w", snapshotName, err)
+	}
+	klog.Infof("snapshot %s is ready to use", snapshotName)
+	return nil
+}
+
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	snapshotId := req.GetSnapshotId()
+	if len(snapshotId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot must be provided snapshot id")
+	}
+
+	unlock := cs.locks.lock(snapshotKey(snapshotId))
+	defer unlock()
+	cs.copies.cancel(snapshotKey(snapshotId))
+	if err := cs.refreshVolumes(ctx); err != nil {
+		return nil, err
+	}
+	snapshot, ok := cs.volumes.getSnapshot(snapshotId)
+	if !ok {
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	_, _, configData, err := resolveRemoteConfig(ctx, req.GetSecrets(), snapshot.SecretNamespace, snapshot.SecretName)
+	if err != nil {
+		return nil, err
+	}
+	if configData == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot delete snapshot %s without a snapshotter secret or secret %s/%s containing configData",
+			snapshotId, snapshot.SecretNamespace, snapshot.SecretName)
+	}
+	configPath, cleanup, err := writeRcloneConfig(configData)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot write rclone config: %v", err)
+	}
+	defer cleanup()
+
+	klog.Infof("purging snapshot %s at %s:%s", snapshotId, snapshot.Remote, snapshot.RemotePath)
+	err = cs.RcloneOps.DeleteVol(ctx, &RcloneVolume{Remote: snapshot.Remote, RemotePath: snapshot.RemotePath}, configPath, nil)
+	if err != nil && !isDirNotFound(err) {
+		return nil, status.Errorf(codes.Internal, "cannot purge snapshot %s: %v", snapshotId, err)
+	}
+	if err := cs.volumes.removeSnapshot(ctx, snapshotId); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot unregister snapshot %s: %v", snapshotId, err)
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := cs.refreshVolumes(ctx); err != nil {
+		return nil, err
+	}
+	ids := cs.volumes.listSnapshots()
+	if snapshotId := req.GetSnapshotId(); snapshotId != "" {
+		ids = []string{}
+		if _, ok := cs.volumes.getSnapshot(snapshotId); ok {
+			ids = append(ids, snapshotId)
+		}
+	}
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for _, id := range ids {
+		snapshot, ok := cs.volumes.getSnapshot(id)
+		if !ok {
+			continue
+		}
+		if volId := req.GetSourceVolumeId(); volId != "" && snapshot.SourceVolumeID != volId {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: newCSISnapshot(id, snapshot)})
+	}
+
+	start, end, nextToken, err := paginate(len(entries), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.refreshVolumes(ctx); err != nil {
+		return nil, err
+	}
+	ids := cs.volumes.list()
+	start, end, nextToken, err := paginate(len(ids), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	publishedNodes, err := cs.publishedNodes(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list published nodes: %v", err)
+	}
+
+	// the volumes are probed concurrently, so that unreachable remotes don't add up their timeouts
+	entries := make([]*csi.ListVolumesResponse_Entry, end-start)
+	probes := make(chan struct{}, volumeProbeConcurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids[start:end] {
+		record, ok := cs.volumes.get(id)
+		if !ok {
+			continue
+		}
+		entries[i] = &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:           id,
+				CapacityBytes:      record.CapacityBytes,
+				AccessibleTopology: toCSITopology(record.AccessibleTopology),
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: publishedNodes[id],
+			},
+		}
+		wg.Add(1)
+		go func(volumeStatus *csi.ListVolumesResponse_VolumeStatus, id string, record volumeRecord) {
+			defer wg.Done()
+			probes <- struct{}{}
+			defer func() { <-probes }()
+			volumeStatus.VolumeCondition = cs.probeVolume(ctx, id, record)
+		}(entries[i].Status, id, record)
+	}
+	wg.Wait()
+	// volumes deleted since they were listed are left out
+	listed := entries[:0]
+	for _, entry := range entries {
+		if entry != nil {
+			listed = append(listed, entry)
+		}
+	}
+	entries = listed
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// GetCapacity reports the free space of the remote of the StorageClass as returned by rclone about
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	// the capacity is requested for a StorageClass, not a PVC, so only a provisioner secret with a fixed
+	// name can be resolved here
+	secretName := req.GetParameters()["csi.storage.k8s.io/provisioner-secret-name"]
+	secretNamespace := req.GetParameters()["csi.storage.k8s.io/provisioner-secret-namespace"]
+	if secretName == "" || secretNamespace == "" || strings.Contains(secretName+secretNamespace, "${") {
+		return &csi.GetCapacityResponse{AvailableCapacity: unknownCapacity}, nil
+	}
+	remote, remotePath, configData, err := resolveRemoteConfig(ctx, nil, secretNamespace, secretName)
+	if err != nil {
+		return nil, err
+	}
+	if remote == "" || configData == "" {
+		return &csi.GetCapacityResponse{AvailableCapacity: unknownCapacity}, nil
+	}
+	configPath, cleanup, err := writeRcloneConfig(configData)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot write rclone config: %v", err)
+	}
+	defer cleanup()
+
+	about, err := cs.RcloneOps.About(ctx, remote, remotePath, configPath)
+	if isAboutUnsupported(err) {
+		return &csi.GetCapacityResponse{AvailableCapacity: unknownCapacity}, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "cannot get capacity of %s:%s: %v", remote, remotePath, err)
+	}
+	available := int64(unknownCapacity)
+	if about.Free != nil {
+		available = *about.Free
+	} else if about.Total != nil && about.Used != nil {
+		available = *about.Total - *about.Used
+	}
+	if available < 0 {
+		available = 0
+	}
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
+}
+
+// publishedNodes maps volume IDs to the nodes they are attached to according to the VolumeAttachments of the
+// driver. Volumes created by the controller are named after their PV, so the PV name is the volume ID.
+func (cs *controllerServer) publishedNodes(ctx context.Context) (map[string][]string, error) {
+	kubeClient, err := kube.GetK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := kubeClient.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	nodes := map[string][]string{}
+	for _, attachment := range attachments.Items {
+		pvName := attachment.Spec.Source.PersistentVolumeName
+		if attachment.Spec.Attacher != cs.driverName || pvName == nil || !attachment.Status.Attached {
+			continue
+		}
+		nodes[*pvName] = append(nodes[*pvName], attachment.Spec.NodeName)
+	}
+	return nodes, nil
+}
+
+// paginate returns the bounds of the requested page of total entries and the token of the next page
+func paginate(total int, startingToken string, maxEntries int32) (int, int, string, error) {
+	if maxEntries < 0 {
+		return 0, 0, "", status.Error(codes.InvalidArgument, "max_entries must not be negative")
+	}
+	start := 0
+	if startingToken != "" {
+		var err error
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > total {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting_token %q", startingToken)
+		}
+	}
+	end := total
+	if maxEntries > 0 && start+int(maxEntries) < total {
+		end = start + int(maxEntries)
+	}
+	nextToken := ""
+	if end < total {
+		nextToken = strconv.Itoa(end)
+	}
+	return start, end, nextToken, nil
+}
+
+func newCSISnapshot(snapshotId string, snapshot snapshotRecord) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     snapshotId,
+		SourceVolumeId: snapshot.SourceVolumeID,
+		SizeBytes:      snapshot.SizeBytes,
+		CreationTime:   timestamppb.New(time.Unix(0, snapshot.CreationTime)),
+		ReadyToUse:     !snapshot.Pending,
+	}
+}
@@ -0,0 +1,340 @@
+package rclone
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"github.com/versioneer-tech/csi-rclone/pkg/kube"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseReclaimParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		policy     string
+		retention  string
+		wantErr    bool
+	}{
+		{name: "default", parameters: map[string]string{}, policy: reclaimPolicyRetain},
+		{name: "purge", parameters: map[string]string{"remoteReclaimPolicy": "purge"}, policy: reclaimPolicyPurge},
+		{name: "archive with retention", parameters: map[string]string{"remoteReclaimPolicy": " archive ", "archiveRetention": "72h"},
+			policy: reclaimPolicyArchive, retention: "72h"},
+		{name: "unknown policy", parameters: map[string]string{"remoteReclaimPolicy": "delete"}, wantErr: true},
+		{name: "retention without archive", parameters: map[string]string{"archiveRetention": "72h"}, wantErr: true},
+		{name: "invalid retention", parameters: map[string]string{"remoteReclaimPolicy": "archive", "archiveRetention": "3 days"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, retention, err := parseReclaimParameters(test.parameters)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got policy %q and retention %q", policy, retention)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if policy != test.policy || retention != test.retention {
+				t.Errorf("got policy %q and retention %q, want %q and %q", policy, retention, test.policy, test.retention)
+			}
+		})
+	}
+}
+
+func TestAccessibleTopology(t *testing.T) {
+	t.Setenv("TOPOLOGY_KEY", "topology.example.com/region")
+	requirements := &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{
+			{Segments: map[string]string{"topology.example.com/region": "eu-central", "zone": "a"}},
+			{Segments: map[string]string{"topology.example.com/region": "eu-central", "zone": "b"}},
+			{Segments: map[string]string{"topology.example.com/region": "eu-west"}},
+			{Segments: map[string]string{"zone": "c"}},
+		},
+		Preferred: []*csi.Topology{
+			{Segments: map[string]string{"topology.example.com/region": "us-east"}},
+		},
+	}
+	want := []map[string]string{
+		{"topology.example.com/region": "eu-central"},
+		{"topology.example.com/region": "eu-west"},
+	}
+	if got := accessibleTopology(requirements); !reflect.DeepEqual(got, want) {
+		t.Errorf("accessibleTopology = %v, want %v", got, want)
+	}
+
+	requirements.Requisite = nil
+	want = []map[string]string{{"topology.example.com/region": "us-east"}}
+	if got := accessibleTopology(requirements); !reflect.DeepEqual(got, want) {
+		t.Errorf("accessibleTopology of preferred segments = %v, want %v", got, want)
+	}
+
+	t.Setenv("TOPOLOGY_KEY", "")
+	if got := accessibleTopology(requirements); got != nil {
+		t.Errorf("accessibleTopology without TOPOLOGY_KEY = %v, want nil", got)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		name          string
+		total         int
+		startingToken string
+		maxEntries    int32
+		start, end    int
+		nextToken     string
+		wantErr       bool
+	}{
+		{name: "all", total: 5, start: 0, end: 5},
+		{name: "first page", total: 5, maxEntries: 2, start: 0, end: 2, nextToken: "2"},
+		{name: "middle page", total: 5, startingToken: "2", maxEntries: 2, start: 2, end: 4, nextToken: "4"},
+		{name: "last page", total: 5, startingToken: "4", maxEntries: 2, start: 4, end: 5},
+		{name: "exact last page", total: 4, startingToken: "2", maxEntries: 2, start: 2, end: 4},
+		{name: "token at the end", total: 5, startingToken: "5", start: 5, end: 5},
+		{name: "empty", total: 0, maxEntries: 10, start: 0, end: 0},
+		{name: "token beyond the end", total: 5, startingToken: "6", wantErr: true},
+		{name: "invalid token", total: 5, startingToken: "next", wantErr: true},
+		{name: "negative token", total: 5, startingToken: "-1", wantErr: true},
+		{name: "negative max entries", total: 5, maxEntries: -1, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end, nextToken, err := paginate(test.total, test.startingToken, test.maxEntries)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got [%d:%d] and next token %q", start, end, nextToken)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if start != test.start || end != test.end || nextToken != test.nextToken {
+				t.Errorf("got [%d:%d] and next token %q, want [%d:%d] and %q", start, end, nextToken, test.start, test.end, test.nextToken)
+			}
+		})
+	}
+}
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	singleWriter := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	readers := mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)
+	multiWriter := mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	if err := validateVolumeCapabilities([]*csi.VolumeCapability{singleWriter, readers}, false); err != nil {
+		t.Errorf("single writer and readers were rejected: %v", err)
+	}
+	if err := validateVolumeCapabilities([]*csi.VolumeCapability{multiWriter}, false); err == nil {
+		t.Error("multi-writer was accepted without allowMultiWriter")
+	}
+	if err := validateVolumeCapabilities([]*csi.VolumeCapability{multiWriter}, true); err != nil {
+		t.Errorf("multi-writer was rejected with allowMultiWriter: %v", err)
+	}
+	if err := validateVolumeCapabilities([]*csi.VolumeCapability{block}, true); err == nil {
+		t.Error("block volume was accepted")
+	}
+	if err := validateVolumeCapabilities([]*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER)}, true); err == nil {
+		t.Error("multi-node single writer was accepted")
+	}
+}
+
+func TestValidateMultiWriterParameters(t *testing.T) {
+	if err := validateMultiWriterParameters(map[string]string{"vfsOpt": `{"cacheMode":"writes"}`}); err != nil {
+		t.Errorf("cacheMode writes was rejected: %v", err)
+	}
+	if err := validateMultiWriterParameters(map[string]string{"vfsOpt": `{"cacheMode":"full"}`}); err == nil {
+		t.Error("cacheMode full was accepted")
+	}
+	if err := validateMultiWriterParameters(map[string]string{"modified.mountOpt": `{"writebackCache":true}`}); err == nil {
+		t.Error("modified writebackCache was accepted")
+	}
+}
+
+// newFakeControllerServer returns a controller server for a fake cluster with objects
+func newFakeControllerServer(t *testing.T, objects ...runtime.Object) *controllerServer {
+	kube.SetK8sClient(fake.NewSimpleClientset(objects...))
+	t.Cleanup(func() { kube.SetK8sClient(nil) })
+	t.Setenv("DRIVER_NAME", "csi-rclone")
+	t.Setenv("NAMESPACE", "csi-rclone")
+	cs, err := NewControllerServer(csicommon.NewCSIDriver("csi-rclone", "test", "node-a"))
+	if err != nil {
+		t.Fatalf("NewControllerServer failed: %v", err)
+	}
+	return cs
+}
+
+func TestControllerPublishVolumeNode(t *testing.T) {
+	ctx := context.Background()
+	cs := newFakeControllerServer(t, &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}})
+	if err := cs.volumes.put(ctx, "pvc-1", volumeRecord{Remote: "s3", RemotePath: "bucket", RemotePathSuffix: "/pvc-1"}); err != nil {
+		t.Fatal(err)
+	}
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-a",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	}
+	if _, err := cs.ControllerPublishVolume(ctx, req); err != nil {
+		t.Fatalf("publish on node-a failed: %v", err)
+	}
+	req.NodeId = "node-b"
+	if _, err := cs.ControllerPublishVolume(ctx, req); status.Code(err) != codes.NotFound {
+		t.Errorf("publish on an unknown node returned %v, want %v", err, codes.NotFound)
+	}
+}
+
+func TestCreateVolumeMutableParameters(t *testing.T) {
+	ctx := context.Background()
+	cs := newFakeControllerServer(t)
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters: map[string]string{
+			"csi.storage.k8s.io/pvc/name":      "data",
+			"csi.storage.k8s.io/pvc/namespace": "team-a",
+			"vfsOpt":                           `{"cacheMode":"writes"}`,
+		},
+		MutableParameters: map[string]string{"vfsOpt": `{"cacheMode":"full"}`},
+	}
+	resp, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if got := resp.GetVolume().GetVolumeContext()[modifiedParameterPrefix+"vfsOpt"]; got != `{"cacheMode":"full"}` {
+		t.Errorf("volume context has modified vfsOpt %q", got)
+	}
+	vfsOpt, _, err := mountOptions(resp.GetVolume().GetVolumeContext(), false)
+	if err != nil {
+		t.Fatalf("mountOptions of the volume context failed: %v", err)
+	}
+	if vfsOpt.CacheMode != "full" {
+		t.Errorf("node mounts with cacheMode %q, want full", vfsOpt.CacheMode)
+	}
+	if record, _ := cs.volumes.get("pvc-1"); record.MutableParameters["vfsOpt"] != `{"cacheMode":"full"}` {
+		t.Errorf("mutable parameters were not registered: %+v", record.MutableParameters)
+	}
+
+	req.Name = "pvc-2"
+	req.MutableParameters = map[string]string{"remotePath": "other"}
+	if _, err := cs.CreateVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateVolume with immutable parameter returned %v, want %v", err, codes.InvalidArgument)
+	}
+
+	req.Name = "pvc-3"
+	req.Parameters["allowMultiWriter"] = "true"
+	req.VolumeCapabilities = []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}
+	req.MutableParameters = map[string]string{"vfsOpt": `{"cacheMode":"full"}`}
+	if _, err := cs.CreateVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("multi-writer CreateVolume with cacheMode full returned %v, want %v", err, codes.InvalidArgument)
+	}
+	if _, ok := cs.volumes.get("pvc-3"); ok {
+		t.Error("refused volume was registered")
+	}
+}
+
+// blockingProbes probes volumes until they are released and records how many probes were in flight at once
+type blockingProbes struct {
+	Operations
+	release     chan struct{}
+	mutex       sync.Mutex
+	running     int
+	maxRunning  int
+	maxDeadline time.Duration
+}
+
+func (b *blockingProbes) Probe(ctx context.Context, rcloneVolume *RcloneVolume, rcloneConfigPath string) error {
+	b.mutex.Lock()
+	b.running++
+	if b.running > b.maxRunning {
+		b.maxRunning = b.running
+	}
+	if deadline, ok := ctx.Deadline(); !ok {
+		b.maxDeadline = -1
+	} else if until := time.Until(deadline); until > b.maxDeadline && b.maxDeadline >= 0 {
+		b.maxDeadline = until
+	}
+	b.mutex.Unlock()
+	defer func() {
+		b.mutex.Lock()
+		b.running--
+		b.mutex.Unlock()
+	}()
+	select {
+	case <-b.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestListVolumesProbesConcurrently(t *testing.T) {
+	ctx := context.Background()
+	cs := newFakeControllerServer(t, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "team-a"},
+		Data:       map[string][]byte{"remote": []byte("s3"), "remotePath": []byte("bucket"), "configData": []byte("[s3]\ntype = s3\n")},
+	})
+	probes := &blockingProbes{release: make(chan struct{})}
+	cs.RcloneOps = probes
+	volumes := volumeProbeConcurrency + 2
+	for i := 0; i < volumes; i++ {
+		record := volumeRecord{SecretName: "data", SecretNamespace: "team-a", RemotePathSuffix: fmt.Sprintf("/pvc-%d", i)}
+		if err := cs.volumes.put(ctx, fmt.Sprintf("pvc-%d", i), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the probes are released once as many as allowed are in flight
+	go func() {
+		for {
+			probes.mutex.Lock()
+			running := probes.running
+			probes.mutex.Unlock()
+			if running == volumeProbeConcurrency {
+				close(probes.release)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	resp, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	if len(resp.GetEntries()) != volumes {
+		t.Fatalf("ListVolumes returned %d volumes, want %d", len(resp.GetEntries()), volumes)
+	}
+	for _, entry := range resp.GetEntries() {
+		if condition := entry.GetStatus().GetVolumeCondition(); condition.GetAbnormal() {
+			t.Errorf("volume %s is abnormal: %s", entry.GetVolume().GetVolumeId(), condition.GetMessage())
+		}
+	}
+	if probes.maxRunning != volumeProbeConcurrency {
+		t.Errorf("%d probes ran at once, want %d", probes.maxRunning, volumeProbeConcurrency)
+	}
+	if probes.maxDeadline < 0 || probes.maxDeadline > volumeProbeTimeout {
+		t.Errorf("probes ran with a deadline of %s, want at most %s", probes.maxDeadline, volumeProbeTimeout)
+	}
+}
@@ -0,0 +1,110 @@
+// Copies of volume content, for snapshots and for volumes cloned or restored from them, take as long as the data
+// takes to transfer. They run in the background, so that the request returns within the timeout of the sidecar,
+// which repeats the request until the copy is done. Requests for one volume or snapshot are serialized with
+// key locks, requests for different ones run in parallel.
+
+package rclone
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+type keyLocks struct {
+	mutex sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	mutex sync.Mutex
+	// users are the holder and the waiters of the lock, it is dropped once there are none
+	users int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: map[string]*keyLock{}}
+}
+
+// lock locks key and returns the function to unlock it again
+func (k *keyLocks) lock(key string) func() {
+	k.mutex.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.users++
+	k.mutex.Unlock()
+
+	l.mutex.Lock()
+	return func() {
+		l.mutex.Unlock()
+		k.mutex.Lock()
+		defer k.mutex.Unlock()
+		l.users--
+		if l.users == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
+
+type copyJobs struct {
+	mutex sync.Mutex
+	jobs  map[string]*copyJob
+}
+
+type copyJob struct {
+	cancel context.CancelFunc
+	done   bool
+	err    error
+}
+
+func newCopyJobs() *copyJobs {
+	return &copyJobs{jobs: map[string]*copyJob{}}
+}
+
+// poll starts copy for key unless it is running already and reports whether it is done. The result of a copy is
+// only reported once, polling again after that starts a new copy.
+func (c *copyJobs) poll(key string, copy func(ctx context.Context) error) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if job, ok := c.jobs[key]; ok {
+		if !job.done {
+			return false, nil
+		}
+		delete(c.jobs, key)
+		return true, job.err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &copyJob{cancel: cancel}
+	c.jobs[key] = job
+	go func() {
+		err := copy(ctx)
+		cancel()
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		job.done = true
+		job.err = err
+	}()
+	return false, nil
+}
+
+// cancel stops the copy for key and forgets its result
+func (c *copyJobs) cancel(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if job, ok := c.jobs[key]; ok {
+		job.cancel()
+		delete(c.jobs, key)
+	}
+}
+
+func volumeKey(volId string) string {
+	return "volume/" + volId
+}
+
+func snapshotKey(snapshotId string) string {
+	return "snapshot/" + snapshotId
+}
@@ -0,0 +1,123 @@
+package rclone
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestKeyLocks(t *testing.T) {
+	locks := newKeyLocks()
+	unlock := locks.lock("volume/a")
+
+	// other keys are not blocked
+	locks.lock("volume/b")()
+
+	locked := make(chan struct{})
+	go func() {
+		unlockAgain := locks.lock("volume/a")
+		close(locked)
+		unlockAgain()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("second lock of the same key did not wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("second lock of the same key was not granted after unlock")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		locks.mutex.Lock()
+		remaining := len(locks.locks)
+		locks.mutex.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unused locks are not dropped, %d remaining", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pollUntilDone polls the copy until it reports a result
+func pollUntilDone(t *testing.T, jobs *copyJobs, key string, copy func(ctx context.Context) error) error {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		done, err := jobs.poll(key, copy)
+		if done {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("copy %s did not finish", key)
+	return nil
+}
+
+func TestCopyJobsPoll(t *testing.T) {
+	jobs := newCopyJobs()
+	release := make(chan struct{})
+	runs := 0
+	copy := func(ctx context.Context) error {
+		runs++
+		<-release
+		return nil
+	}
+
+	if done, err := jobs.poll("snapshot/a", copy); done || err != nil {
+		t.Fatalf("first poll reported done=%v err=%v", done, err)
+	}
+	if done, err := jobs.poll("snapshot/a", copy); done || err != nil {
+		t.Fatalf("poll of a running copy reported done=%v err=%v", done, err)
+	}
+	close(release)
+	if err := pollUntilDone(t, jobs, "snapshot/a", copy); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if runs != 1 {
+		t.Errorf("copy ran %d times, want 1", runs)
+	}
+}
+
+func TestCopyJobsError(t *testing.T) {
+	jobs := newCopyJobs()
+	copyErr := errors.New("copy failed")
+	err := pollUntilDone(t, jobs, "volume/a", func(ctx context.Context) error { return copyErr })
+	if !errors.Is(err, copyErr) {
+		t.Fatalf("got error %v, want %v", err, copyErr)
+	}
+	// the result is only reported once, the next poll retries the copy
+	if done, _ := jobs.poll("volume/a", func(ctx context.Context) error { return nil }); done {
+		t.Error("result of a failed copy was reported twice")
+	}
+}
+
+func TestCopyJobsCancel(t *testing.T) {
+	jobs := newCopyJobs()
+	cancelled := make(chan error, 1)
+	jobs.poll("snapshot/a", func(ctx context.Context) error {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return ctx.Err()
+	})
+	jobs.cancel("snapshot/a")
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("copy ended with %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancel did not stop the copy")
+	}
+	if len(jobs.jobs) != 0 {
+		t.Errorf("cancelled copy was not forgotten: %v", jobs.jobs)
+	}
+}
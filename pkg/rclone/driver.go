@@ -2,13 +2,14 @@ package rclone
 
 import (
 	"fmt"
-	"net"
 	"os"
-	"sync"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 	"github.com/versioneer-tech/csi-rclone/pkg/kube"
+	"github.com/versioneer-tech/csi-rclone/pkg/metrics"
+	"golang.org/x/net/context"
 	"k8s.io/klog"
 	"k8s.io/utils/mount"
 
@@ -30,16 +31,16 @@ var (
 	DriverVersion = "github.com/versioneer-tech/csi-rclone"
 )
 
-func getFreePort() (port int, err error) {
-	var a *net.TCPAddr
-	if a, err = net.ResolveTCPAddr("tcp", "localhost:0"); err == nil {
-		var l *net.TCPListener
-		if l, err = net.ListenTCP("tcp", a); err == nil {
-			defer l.Close()
-			return l.Addr().(*net.TCPAddr).Port, nil
-		}
-	}
-	return
+// topologyKey is the node label that volumes are constrained to, e.g. the region that can reach an
+// S3 endpoint. Volumes are accessible from all nodes if it is not set.
+func topologyKey() string {
+	return strings.TrimSpace(os.Getenv("TOPOLOGY_KEY"))
+}
+
+// MounterImage is the image of the mounter pods. If it is set, the rclone mounts of the volumes run in their own
+// pods on the node instead of the node plugin, so that they survive restarts and upgrades of the plugin.
+func MounterImage() string {
+	return strings.TrimSpace(os.Getenv("MOUNTER_IMAGE"))
 }
 
 func NewDriver(nodeID, endpoint string) *Driver {
@@ -55,10 +56,23 @@ func NewDriver(nodeID, endpoint string) *Driver {
 	d.CSIDriver = csicommon.NewCSIDriver(driverName, DriverVersion, nodeID)
 	d.CSIDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 	})
 	d.CSIDriver.AddControllerServiceCapabilities(
 		[]csi.ControllerServiceCapability_RPC_Type{
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+			csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 		})
 
 	return d
@@ -70,28 +84,65 @@ func NewNodeServer(csiDriver *csicommon.CSIDriver) (*nodeServer, error) {
 		return nil, err
 	}
 
-	rclonePort, err := getFreePort()
+	rcloneOps, err := NewRclone(kubeClient)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot get a free TCP port to run rclone")
+		return nil, err
 	}
-	rcloneOps := NewRclone(kubeClient, rclonePort)
 
-	return &nodeServer{
+	state, err := loadMountState(os.Getenv("STATE_DIR"))
+	if err != nil {
+		return nil, err
+	}
+
+	ns := &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(csiDriver),
 		mounter: &mount.SafeFormatAndMount{
 			Interface: mount.New(""),
 			Exec:      utilexec.New(),
 		},
-		RcloneOps: rcloneOps,
-	}, nil
+		RcloneOps:   rcloneOps,
+		volumeLocks: newKeyLocks(),
+		state:       state,
+		listings:    map[string]bool{},
+		stop:        make(chan struct{}),
+	}
+	if image := MounterImage(); image != "" {
+		info, err := ns.DefaultNodeServer.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+		if err != nil {
+			return nil, err
+		}
+		ns.mounterPods = newMounterPods(kubeClient, ns.mounter, kube.Namespace(), os.Getenv("DRIVER_NAME"), info.NodeId, image)
+	}
+	return ns, nil
 }
 
-func NewControllerServer(csiDriver *csicommon.CSIDriver) *controllerServer {
+func NewControllerServer(csiDriver *csicommon.CSIDriver) (*controllerServer, error) {
+	kubeClient, err := kube.GetK8sClient()
+	if err != nil {
+		return nil, err
+	}
+
+	driverName := os.Getenv("DRIVER_NAME")
+	registryName := fmt.Sprintf("%s-volumes", driverName)
+	volumes := newVolumeRegistry(kubeClient, kube.Namespace(), registryName)
+	if err := volumes.load(context.Background()); err != nil {
+		return nil, err
+	}
+
+	rcloneOps, err := NewRclone(kubeClient)
+	if err != nil {
+		return nil, err
+	}
+
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(csiDriver),
-		active_volumes:          map[string]int64{},
-		mutex:                   sync.RWMutex{},
-	}
+		RcloneOps:               rcloneOps,
+		driverName:              driverName,
+		volumes:                 volumes,
+		writers:                 newWriterLeases(kubeClient, kube.Namespace(), driverName),
+		locks:                   newKeyLocks(),
+		copies:                  newCopyJobs(),
+	}, nil
 }
 
 func (d *Driver) WithNodeServer(ns *nodeServer) *Driver {
@@ -105,16 +156,19 @@ func (d *Driver) WithControllerServer(cs *controllerServer) *Driver {
 }
 
 func (d *Driver) Run() error {
+	if metricsAddress := os.Getenv("METRICS_ADDRESS"); metricsAddress != "" {
+		metrics.Serve(metricsAddress)
+	}
 	s := csicommon.NewNonBlockingGRPCServer()
 	s.Start(
 		d.endpoint,
-		csicommon.NewDefaultIdentityServer(d.CSIDriver),
+		NewIdentityServer(d.CSIDriver),
 		d.cs,
 		d.ns,
 	)
 	d.server = s
 	if d.ns != nil && d.ns.RcloneOps != nil {
-		return d.ns.RcloneOps.Run()
+		return d.ns.runDaemon()
 	}
 	s.Wait()
 	return nil
@@ -123,6 +177,7 @@ func (d *Driver) Run() error {
 func (d *Driver) Stop() error {
 	var err error
 	if d.ns != nil && d.ns.RcloneOps != nil {
+		d.ns.stopOnce.Do(func() { close(d.ns.stop) })
 		err = d.ns.RcloneOps.Cleanup()
 	}
 	if d.server != nil {
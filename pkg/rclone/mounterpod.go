@@ -0,0 +1,413 @@
+// Mounter pods run the rclone mount of a volume outside of the node plugin, so that upgrading or restarting the
+// plugin does not kill the mounts. Every staged volume gets its own pod on the node, which mounts the volume at the
+// staging path with bidirectional mount propagation and unmounts it when the pod is deleted on unstage.
+
+package rclone
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	os_exec "os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"k8s.io/utils/mount"
+)
+
+const (
+	mounterSpecFile = "mount.json"
+	mounterSpecDir  = "/spec"
+
+	// mounterStartTimeout includes pulling the image on the node
+	mounterStartTimeout = 2 * time.Minute
+	mounterStopTimeout  = time.Minute
+	mounterPollInterval = time.Second
+)
+
+// mounterSpec is passed to the mounter pod in a Secret
+type mounterSpec struct {
+	Remote     string            `json:"remote"`
+	RemotePath string            `json:"remotePath"`
+	ConfigData string            `json:"configData"`
+	MountPoint string            `json:"mountPoint"`
+	ReadOnly   bool              `json:"readOnly,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+type mounterPods struct {
+	kubeClient kubernetes.Interface
+	mounter    mount.Interface
+	namespace  string
+	driverName string
+	nodeId     string
+	image      string
+}
+
+func newMounterPods(kubeClient kubernetes.Interface, mounter mount.Interface, namespace, driverName, nodeId, image string) *mounterPods {
+	return &mounterPods{
+		kubeClient: kubeClient,
+		mounter:    mounter,
+		namespace:  namespace,
+		driverName: driverName,
+		nodeId:     nodeId,
+		image:      image,
+	}
+}
+
+// podName is unique per volume and node, as a volume can be staged on several nodes
+func (m *mounterPods) podName(volumeId string) string {
+	return hashedName("rclone-mounter-"+volumeId, m.nodeId+"/"+volumeId)
+}
+
+func (m *mounterPods) appLabel() string {
+	return fmt.Sprintf("%s-mounter", m.driverName)
+}
+
+func (m *mounterPods) volumeIdAnnotation() string {
+	return fmt.Sprintf("%s/volume-id", m.driverName)
+}
+
+// Start starts the mounter pod of the volume, which mounts it at targetPath. WaitMounted waits for the mount.
+func (m *mounterPods) Start(ctx context.Context, rcloneVolume *RcloneVolume, targetPath, rcloneConfigData string, readOnly bool, parameters map[string]string) error {
+	if _, err := parseConfigData(rcloneConfigData); err != nil {
+		return fmt.Errorf("mounting failed: %w", err)
+	}
+	vfsOpt, mountOpt, err := mountOptions(parameters, readOnly)
+	if err != nil {
+		return err
+	}
+	if parameters[multiWriterParameter] == "true" {
+		if err = validateMultiWriter(vfsOpt, mountOpt); err != nil {
+			return fmt.Errorf("invalid argument: %w", err)
+		}
+	}
+	spec, err := json.Marshal(mounterSpec{
+		Remote:     rcloneVolume.Remote,
+		RemotePath: rcloneVolume.RemotePath,
+		ConfigData: rcloneConfigData,
+		MountPoint: targetPath,
+		ReadOnly:   readOnly,
+		Parameters: parameters,
+	})
+	if err != nil {
+		return fmt.Errorf("mounting failed: couldn't create mounter spec: %s", err)
+	}
+
+	name := m.podName(rcloneVolume.ID)
+	created := true
+	pod, err := m.kubeClient.CoreV1().Pods(m.namespace).Create(ctx, m.newPod(name, rcloneVolume.ID, targetPath), metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		created = false
+		pod, err = m.kubeClient.CoreV1().Pods(m.namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("mounting failed: couldn't create mounter pod %s: %w", name, err)
+	}
+	// the secret is owned by the pod, so that it is garbage collected with it
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: m.namespace,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Name:       pod.Name,
+				UID:        pod.UID,
+			}},
+		},
+		Data: map[string][]byte{mounterSpecFile: spec},
+	}
+	if _, err = m.kubeClient.CoreV1().Secrets(m.namespace).Create(ctx, secret, metav1.CreateOptions{}); apierrors.IsAlreadyExists(err) {
+		_, err = m.kubeClient.CoreV1().Secrets(m.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		// a pod without its spec never starts, it is deleted even if the request was cancelled
+		if created {
+			if err := m.kubeClient.CoreV1().Pods(m.namespace).Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				klog.Warningf("cannot delete mounter pod %s without spec: %v", name, err)
+			}
+		}
+		return fmt.Errorf("mounting failed: couldn't create spec of mounter pod %s: %w", name, err)
+	}
+	klog.Infof("started mounter pod %s for volume %s", name, rcloneVolume.ID)
+	return nil
+}
+
+// WaitMounted waits until the mount of the mounter pod of the volume shows up at targetPath
+func (m *mounterPods) WaitMounted(ctx context.Context, volumeId, targetPath string) error {
+	name := m.podName(volumeId)
+	deadline := time.Now().Add(mounterStartTimeout)
+	for {
+		if notMnt, err := m.mounter.IsLikelyNotMountPoint(targetPath); err == nil && !notMnt {
+			klog.Infof("mounter pod %s mounted volume %s at %s", name, volumeId, targetPath)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("mounting failed: mounter pod %s did not mount %s within %s", name, targetPath, mounterStartTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("mounting failed: waiting for mounter pod %s: %w", name, ctx.Err())
+		case <-time.After(mounterPollInterval):
+		}
+	}
+}
+
+// Stop deletes the mounter pod of the volume, rclone unmounts the volume when it is terminated. WaitUnmounted waits
+// for the unmount.
+func (m *mounterPods) Stop(ctx context.Context, volumeId string) error {
+	// pods of earlier versions are named differently and found by their volume
+	pods, err := m.kubeClient.CoreV1().Pods(m.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("app=%s", m.appLabel()),
+		FieldSelector: fmt.Sprintf("spec.nodeName=%s", m.nodeId),
+	})
+	if err != nil {
+		return fmt.Errorf("unmounting failed: couldn't list mounter pods: %w", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Annotations[m.volumeIdAnnotation()] != volumeId {
+			continue
+		}
+		err := m.kubeClient.CoreV1().Pods(m.namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("unmounting failed: couldn't delete mounter pod %s: %w", pod.Name, err)
+		}
+	}
+	return nil
+}
+
+// WaitUnmounted waits until the mount of the volume at targetPath is gone
+func (m *mounterPods) WaitUnmounted(ctx context.Context, volumeId, targetPath string) error {
+	name := m.podName(volumeId)
+	deadline := time.Now().Add(mounterStopTimeout)
+	for {
+		notMnt, err := m.mounter.IsLikelyNotMountPoint(targetPath)
+		if err != nil || notMnt {
+			klog.Infof("mounter pod %s unmounted volume %s", name, volumeId)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("unmounting failed: mounter pod %s did not unmount %s within %s", name, targetPath, mounterStopTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("unmounting failed: waiting for mounter pod %s: %w", name, ctx.Err())
+		case <-time.After(mounterPollInterval):
+		}
+	}
+}
+
+func (m *mounterPods) newPod(name, volumeId, targetPath string) *v1.Pod {
+	privileged := true
+	automountToken := false
+	propagation := v1.MountPropagationBidirectional
+	hostPathType := v1.HostPathDirectoryOrCreate
+	specMode := int32(0400)
+	// the parent of the staging path is shared with the host, so that the mount propagates to the kubelet
+	hostDir := filepath.Dir(targetPath)
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: m.namespace,
+			Labels: map[string]string{
+				"app": m.appLabel(),
+			},
+			Annotations: map[string]string{
+				m.volumeIdAnnotation(): volumeId,
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeName:                     m.nodeId,
+			RestartPolicy:                v1.RestartPolicyAlways,
+			AutomountServiceAccountToken: &automountToken,
+			Tolerations:                  []v1.Toleration{{Operator: v1.TolerationOpExists}},
+			Containers: []v1.Container{{
+				Name:    "rclone-mount",
+				Image:   m.image,
+				Command: []string{"/csi-rclone", "mounter", fmt.Sprintf("--spec=%s", filepath.Join(mounterSpecDir, mounterSpecFile))},
+				Env: []v1.EnvVar{{
+					Name:  "LOG_LEVEL",
+					Value: os.Getenv("LOG_LEVEL"),
+				}},
+				SecurityContext: &v1.SecurityContext{Privileged: &privileged},
+				VolumeMounts: []v1.VolumeMount{
+					{Name: "spec", MountPath: mounterSpecDir, ReadOnly: true},
+					{Name: "staging-dir", MountPath: hostDir, MountPropagation: &propagation},
+				},
+			}},
+			Volumes: []v1.Volume{
+				{
+					Name: "spec",
+					VolumeSource: v1.VolumeSource{
+						Secret: &v1.SecretVolumeSource{SecretName: name, DefaultMode: &specMode},
+					},
+				},
+				{
+					Name: "staging-dir",
+					VolumeSource: v1.VolumeSource{
+						HostPath: &v1.HostPathVolumeSource{Path: hostDir, Type: &hostPathType},
+					},
+				},
+			},
+		},
+	}
+}
+
+// RunMounter mounts the volume described by the spec file in the foreground. It runs in the mounter pod and
+// replaces itself with rclone mount, which unmounts the volume when the pod is terminated.
+func RunMounter(specPath string) error {
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		return fmt.Errorf("cannot read mounter spec: %w", err)
+	}
+	var spec mounterSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("cannot decode mounter spec: %w", err)
+	}
+	sec, err := parseConfigData(spec.ConfigData)
+	if err != nil {
+		return err
+	}
+	vfsOpt, mountOpt, err := mountOptions(spec.Parameters, spec.ReadOnly)
+	if err != nil {
+		return err
+	}
+
+	configDir, err := os.MkdirTemp("", "rclone-mount-")
+	if err != nil {
+		return err
+	}
+	configPath := filepath.Join(configDir, "rclone.conf")
+	// rclone config create obscures the passwords like config/create of the rc API does for the node plugin
+	args := []string{"config", "create", sec.Name(), sec.Key("type").String()}
+	for _, key := range sec.KeyStrings() {
+		if key == "type" {
+			continue
+		}
+		args = append(args, key, sec.Key(key).String())
+	}
+	args = append(args, "config_refresh_token", "false", "--obscure", "--non-interactive", fmt.Sprintf("--config=%s", configPath))
+	if out, err := os_exec.Command("rclone", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot create rclone config: %v output: %q", err, string(out))
+	}
+
+	// a mount of a previous run of the pod is dead and has to be removed first
+	mounter := mount.New("")
+	if notMnt, err := mounter.IsLikelyNotMountPoint(spec.MountPoint); err != nil && !os.IsNotExist(err) || err == nil && !notMnt {
+		klog.Warningf("unmounting stale mount at %s", spec.MountPoint)
+		if err := mounter.Unmount(spec.MountPoint); err != nil {
+			return fmt.Errorf("cannot unmount stale mount at %s: %w", spec.MountPoint, err)
+		}
+	}
+	if err := os.MkdirAll(spec.MountPoint, 0750); err != nil {
+		return err
+	}
+
+	rclonePath, err := os_exec.LookPath("rclone")
+	if err != nil {
+		return err
+	}
+	loglevel := os.Getenv("LOG_LEVEL")
+	if len(loglevel) == 0 {
+		loglevel = "NOTICE"
+	}
+	mountArgs := []string{"rclone", "mount", fmt.Sprintf("%s:%s", sec.Name(), spec.RemotePath), spec.MountPoint,
+		fmt.Sprintf("--config=%s", configPath), fmt.Sprintf("--log-level=%s", loglevel)}
+	mountArgs = append(mountArgs, mountFlags(vfsOpt, mountOpt)...)
+	klog.Infof("running %s", strings.Join(mountArgs[:4], " "))
+	return syscall.Exec(rclonePath, mountArgs, os.Environ())
+}
+
+// mountFlags converts the options of the rc API into the flags of rclone mount
+func mountFlags(vfsOpt VfsOpt, mountOpt MountOpt) []string {
+	flags := []string{}
+	boolFlag := func(name string, value bool) {
+		if value {
+			flags = append(flags, "--"+name)
+		}
+	}
+	durationFlag := func(name string, value time.Duration) {
+		if value != 0 {
+			flags = append(flags, fmt.Sprintf("--%s=%s", name, value))
+		}
+	}
+	// sizes without suffix would be read as KiB
+	sizeFlag := func(name string, value int64) {
+		if value != 0 {
+			flags = append(flags, fmt.Sprintf("--%s=%dB", name, value))
+		}
+	}
+	octalFlag := func(name string, value uint32) {
+		if value != 0 {
+			flags = append(flags, fmt.Sprintf("--%s=%03o", name, value))
+		}
+	}
+	stringFlag := func(name string, value string) {
+		if value != "" {
+			flags = append(flags, fmt.Sprintf("--%s=%s", name, value))
+		}
+	}
+
+	boolFlag("no-seek", vfsOpt.NoSeek)
+	boolFlag("no-checksum", vfsOpt.NoChecksum)
+	boolFlag("read-only", vfsOpt.ReadOnly)
+	boolFlag("no-modtime", vfsOpt.NoModTime)
+	durationFlag("dir-cache-time", vfsOpt.DirCacheTime)
+	boolFlag("vfs-refresh", vfsOpt.Refresh)
+	durationFlag("poll-interval", vfsOpt.PollInterval)
+	octalFlag("umask", uint32(vfsOpt.Umask))
+	if vfsOpt.UID != 0 {
+		flags = append(flags, fmt.Sprintf("--uid=%d", vfsOpt.UID))
+	}
+	if vfsOpt.GID != 0 {
+		flags = append(flags, fmt.Sprintf("--gid=%d", vfsOpt.GID))
+	}
+	octalFlag("dir-perms", uint32(vfsOpt.DirPerms.Perm()))
+	octalFlag("file-perms", uint32(vfsOpt.FilePerms.Perm()))
+	sizeFlag("vfs-read-chunk-size", vfsOpt.ChunkSize)
+	sizeFlag("vfs-read-chunk-size-limit", vfsOpt.ChunkSizeLimit)
+	stringFlag("vfs-cache-mode", vfsOpt.CacheMode)
+	durationFlag("vfs-cache-max-age", vfsOpt.CacheMaxAge)
+	sizeFlag("vfs-cache-max-size", vfsOpt.CacheMaxSize)
+	sizeFlag("vfs-cache-min-free-space", vfsOpt.CacheMinFreeSpace)
+	durationFlag("vfs-cache-poll-interval", vfsOpt.CachePollInterval)
+	boolFlag("vfs-case-insensitive", vfsOpt.CaseInsensitive)
+	durationFlag("vfs-write-wait", vfsOpt.WriteWait)
+	durationFlag("vfs-read-wait", vfsOpt.ReadWait)
+	durationFlag("vfs-write-back", vfsOpt.WriteBack)
+	sizeFlag("vfs-read-ahead", vfsOpt.ReadAhead)
+	boolFlag("vfs-used-is-size", vfsOpt.UsedIsSize)
+	boolFlag("vfs-fast-fingerprint", vfsOpt.FastFingerprint)
+	sizeFlag("vfs-disk-space-total-size", vfsOpt.DiskSpaceTotalSize)
+
+	boolFlag("debug-fuse", mountOpt.DebugFUSE)
+	boolFlag("allow-non-empty", mountOpt.AllowNonEmpty)
+	boolFlag("allow-root", mountOpt.AllowRoot)
+	boolFlag("allow-other", mountOpt.AllowOther)
+	boolFlag("default-permissions", mountOpt.DefaultPermissions)
+	boolFlag("write-back-cache", mountOpt.WritebackCache)
+	durationFlag("daemon-wait", mountOpt.DaemonWait)
+	sizeFlag("max-read-ahead", mountOpt.MaxReadAhead)
+	for _, option := range mountOpt.ExtraOptions {
+		flags = append(flags, fmt.Sprintf("--option=%s", option))
+	}
+	for _, flag := range mountOpt.ExtraFlags {
+		flags = append(flags, fmt.Sprintf("--fuse-flag=%s", flag))
+	}
+	durationFlag("attr-timeout", mountOpt.AttrTimeout)
+	stringFlag("devname", mountOpt.DeviceName)
+	stringFlag("volname", mountOpt.VolumeName)
+	boolFlag("noappledouble", mountOpt.NoAppleDouble)
+	boolFlag("noapplexattr", mountOpt.NoAppleXattr)
+	boolFlag("async-read", mountOpt.AsyncRead)
+	return flags
+}
@@ -0,0 +1,121 @@
+package rclone
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/mount"
+)
+
+func TestMountFlags(t *testing.T) {
+	vfsOpt := VfsOpt{
+		ReadOnly:     true,
+		DirCacheTime: time.Minute,
+		Umask:        022,
+		DirPerms:     0755,
+		ChunkSize:    1024,
+		CacheMode:    "writes",
+	}
+	mountOpt := MountOpt{
+		AllowOther:   true,
+		ExtraOptions: []string{"ro"},
+		ExtraFlags:   []string{"nodev"},
+	}
+	want := []string{
+		"--read-only",
+		"--dir-cache-time=1m0s",
+		"--umask=022",
+		"--dir-perms=755",
+		"--vfs-read-chunk-size=1024B",
+		"--vfs-cache-mode=writes",
+		"--allow-other",
+		"--option=ro",
+		"--fuse-flag=nodev",
+	}
+	if got := mountFlags(vfsOpt, mountOpt); !reflect.DeepEqual(got, want) {
+		t.Errorf("mountFlags = %v, want %v", got, want)
+	}
+
+	if got := mountFlags(VfsOpt{}, MountOpt{}); len(got) != 0 {
+		t.Errorf("mountFlags of empty options = %v, want none", got)
+	}
+}
+
+func newTestMounterPods() (*mounterPods, *fake.Clientset) {
+	client := fake.NewSimpleClientset()
+	return newMounterPods(client, mount.NewFakeMounter(nil), "csi-rclone", "csi-rclone", "node-a", "csi-rclone:test"), client
+}
+
+func TestMounterPodStart(t *testing.T) {
+	ctx := context.Background()
+	pods, client := newTestMounterPods()
+	volume := &RcloneVolume{ID: "pvc-1", Remote: "s3", RemotePath: "bucket/pvc-1"}
+	for i := 0; i < 2; i++ {
+		if err := pods.Start(ctx, volume, "/staging/pvc-1", "[s3]\ntype = s3\n", false, map[string]string{}); err != nil {
+			t.Fatalf("start %d failed: %v", i, err)
+		}
+	}
+	name := pods.podName("pvc-1")
+	pod, err := client.CoreV1().Pods("csi-rclone").Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("mounter pod was not created: %v", err)
+	}
+	secret, err := client.CoreV1().Secrets("csi-rclone").Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("spec of the mounter pod was not created: %v", err)
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].Name != pod.Name {
+		t.Errorf("owner references of the spec = %+v, want the mounter pod", secret.OwnerReferences)
+	}
+
+	if err := pods.Stop(ctx, "pvc-1"); err != nil {
+		t.Fatalf("stop failed: %v", err)
+	}
+	if _, err := client.CoreV1().Pods("csi-rclone").Get(ctx, name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("mounter pod was not deleted: %v", err)
+	}
+}
+
+func TestMounterPodStartWithoutSpec(t *testing.T) {
+	ctx := context.Background()
+	pods, client := newTestMounterPods()
+	client.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "", errors.New("denied"))
+	})
+	volume := &RcloneVolume{ID: "pvc-1", Remote: "s3", RemotePath: "bucket/pvc-1"}
+	if err := pods.Start(ctx, volume, "/staging/pvc-1", "[s3]\ntype = s3\n", false, map[string]string{}); err == nil {
+		t.Fatal("start without spec did not fail")
+	}
+	remaining, err := client.CoreV1().Pods("csi-rclone").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining.Items) != 0 {
+		t.Errorf("mounter pod without spec was not deleted: %+v", remaining.Items)
+	}
+}
+
+func TestMounterPodWaitCancelled(t *testing.T) {
+	pods, _ := newTestMounterPods()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan error)
+	go func() { done <- pods.WaitMounted(ctx, "pvc-1", t.TempDir()) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("WaitMounted returned %v, want the cancellation", err)
+		}
+	case <-time.After(mounterPollInterval * 5):
+		t.Fatal("WaitMounted did not return when the request was cancelled")
+	}
+}
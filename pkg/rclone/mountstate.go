@@ -0,0 +1,175 @@
+// The mount state records the volumes mounted by the node plugin in a local file below the plugin dir. It is the
+// node's source of truth for what it mounted: publish and unpublish check it to stay idempotent, the mounts are
+// re-created from it after the plugin and with it the rclone daemon restarted, and `rclone state` prints it for
+// debugging. It contains no credentials, the secrets of a volume are read again from its PV when it is recovered.
+
+package rclone
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const mountStateFile = "mounts.json"
+
+type stagedVolume struct {
+	VolumeId    string `json:"volumeId"`
+	StagingPath string `json:"stagingPath"`
+	ConfigName  string `json:"configName"`
+	Remote      string `json:"remote"`
+	RemotePath  string `json:"remotePath"`
+	ReadOnly    bool   `json:"readOnly,omitempty"`
+	MultiWriter bool   `json:"multiWriter,omitempty"`
+	// TargetPaths are the bind mounts of the staging path and whether they are read-only
+	TargetPaths map[string]bool `json:"targetPaths,omitempty"`
+}
+
+// mountState is not safe for concurrent use, the node server serializes access to it
+type mountState struct {
+	// path is empty if the state is only kept in memory
+	path    string
+	volumes map[string]stagedVolume
+}
+
+// loadMountState reads the state from dir. Without a dir the state is not persisted.
+func loadMountState(dir string) (*mountState, error) {
+	state := &mountState{volumes: map[string]stagedVolume{}}
+	if dir == "" {
+		return state, nil
+	}
+	state.path = filepath.Join(dir, mountStateFile)
+	data, err := os.ReadFile(state.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read mount state %s: %w", state.path, err)
+	}
+	if err := json.Unmarshal(data, &state.volumes); err != nil {
+		return nil, fmt.Errorf("cannot decode mount state %s: %w", state.path, err)
+	}
+	return state, nil
+}
+
+// list returns the staged volumes ordered by volume ID
+func (s *mountState) list() []stagedVolume {
+	volumes := make([]stagedVolume, 0, len(s.volumes))
+	for _, id := range sortedKeys(s.volumes) {
+		volumes = append(volumes, s.volumes[id])
+	}
+	return volumes
+}
+
+func (s *mountState) getVolume(volumeId string) (stagedVolume, bool) {
+	volume, ok := s.volumes[volumeId]
+	return volume, ok
+}
+
+// hasTarget reports if targetPath is a recorded bind mount of the volume
+func (s *mountState) hasTarget(volumeId, targetPath string) bool {
+	_, ok := s.volumes[volumeId].TargetPaths[targetPath]
+	return ok
+}
+
+func (s *mountState) putVolume(volume stagedVolume) error {
+	if existing, ok := s.volumes[volume.VolumeId]; ok && volume.TargetPaths == nil {
+		volume.TargetPaths = existing.TargetPaths
+	}
+	s.volumes[volume.VolumeId] = volume
+	return s.save()
+}
+
+func (s *mountState) removeVolume(volumeId string) error {
+	if _, ok := s.volumes[volumeId]; !ok {
+		return nil
+	}
+	delete(s.volumes, volumeId)
+	return s.save()
+}
+
+func (s *mountState) addTarget(volumeId, targetPath string, readOnly bool) error {
+	volume, ok := s.volumes[volumeId]
+	if !ok {
+		return fmt.Errorf("volume %s is not staged", volumeId)
+	}
+	if volume.TargetPaths == nil {
+		volume.TargetPaths = map[string]bool{}
+	}
+	volume.TargetPaths[targetPath] = readOnly
+	s.volumes[volumeId] = volume
+	return s.save()
+}
+
+func (s *mountState) removeTarget(volumeId, targetPath string) error {
+	volume, ok := s.volumes[volumeId]
+	if !ok {
+		return nil
+	}
+	if _, ok := volume.TargetPaths[targetPath]; !ok {
+		return nil
+	}
+	delete(volume.TargetPaths, targetPath)
+	return s.save()
+}
+
+// save replaces the state file atomically, so that a crash never leaves a partially written state behind
+func (s *mountState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.volumes)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), mountStateFile+".*")
+	if err != nil {
+		return fmt.Errorf("cannot write mount state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write mount state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot write mount state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("cannot write mount state: %w", err)
+	}
+	return nil
+}
+
+// targetPaths returns the bind mounts of volume ordered by path
+func (v stagedVolume) targetPaths() []string {
+	return sortedKeys(v.TargetPaths)
+}
+
+// refCount is the number of pods on the node using the mount of the volume
+func (v stagedVolume) refCount() int {
+	return len(v.TargetPaths)
+}
+
+// DumpMountState writes the mount state in dir to w
+func DumpMountState(w io.Writer, dir string) error {
+	if dir == "" {
+		return fmt.Errorf("no state dir given")
+	}
+	state, err := loadMountState(dir)
+	if err != nil {
+		return err
+	}
+	type volumeDump struct {
+		stagedVolume
+		RefCount int `json:"refCount"`
+	}
+	dump := make([]volumeDump, 0, len(state.volumes))
+	for _, volume := range state.list() {
+		dump = append(dump, volumeDump{stagedVolume: volume, RefCount: volume.refCount()})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dump)
+}
@@ -0,0 +1,152 @@
+package rclone
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMountStatePersistence(t *testing.T) {
+	dir := t.TempDir()
+	state, err := loadMountState(dir)
+	if err != nil {
+		t.Fatalf("loadMountState without a state file failed: %v", err)
+	}
+	if len(state.list()) != 0 {
+		t.Fatalf("new mount state is not empty: %v", state.list())
+	}
+
+	volume := stagedVolume{
+		VolumeId:    "pvc-1",
+		StagingPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/csi-rclone/1/globalmount",
+		ConfigName:  "rclone-mounter-pvc-1-0123abcd",
+		Remote:      "s3",
+		RemotePath:  "bucket/pvc-1",
+		MultiWriter: true,
+	}
+	if err := state.putVolume(volume); err != nil {
+		t.Fatalf("putVolume failed: %v", err)
+	}
+	if err := state.addTarget("pvc-1", "/pods/b/mount", true); err != nil {
+		t.Fatalf("addTarget failed: %v", err)
+	}
+	if err := state.addTarget("pvc-1", "/pods/a/mount", false); err != nil {
+		t.Fatalf("addTarget failed: %v", err)
+	}
+	if err := state.addTarget("pvc-2", "/pods/c/mount", false); err == nil {
+		t.Error("addTarget of a volume that is not staged did not fail")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, mountStateFile))
+	if err != nil {
+		t.Fatalf("mount state was not saved: %v", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("mount state is readable by others: %v", info.Mode().Perm())
+	}
+
+	loaded, err := loadMountState(dir)
+	if err != nil {
+		t.Fatalf("loadMountState failed: %v", err)
+	}
+	got, ok := loaded.getVolume("pvc-1")
+	if !ok {
+		t.Fatal("volume pvc-1 was not persisted")
+	}
+	if !reflect.DeepEqual(got.targetPaths(), []string{"/pods/a/mount", "/pods/b/mount"}) {
+		t.Errorf("targetPaths = %v", got.targetPaths())
+	}
+	if got.refCount() != 2 || !got.TargetPaths["/pods/b/mount"] || got.TargetPaths["/pods/a/mount"] {
+		t.Errorf("target paths were not persisted with their read-only flag: %v", got.TargetPaths)
+	}
+	if got.Remote != volume.Remote || got.ConfigName != volume.ConfigName || !got.MultiWriter {
+		t.Errorf("loaded volume %+v differs from %+v", got, volume)
+	}
+
+	// updating the volume keeps its targets
+	volume.ConfigName = "rclone-mounter-pvc-1-4567cdef"
+	if err := loaded.putVolume(volume); err != nil {
+		t.Fatalf("putVolume failed: %v", err)
+	}
+	if !loaded.hasTarget("pvc-1", "/pods/a/mount") {
+		t.Error("putVolume dropped the targets of the volume")
+	}
+
+	if err := loaded.removeTarget("pvc-1", "/pods/a/mount"); err != nil {
+		t.Fatalf("removeTarget failed: %v", err)
+	}
+	if err := loaded.removeTarget("pvc-1", "/pods/a/mount"); err != nil {
+		t.Fatalf("removing a removed target failed: %v", err)
+	}
+	if loaded.hasTarget("pvc-1", "/pods/a/mount") || !loaded.hasTarget("pvc-1", "/pods/b/mount") {
+		t.Errorf("removeTarget removed the wrong targets: %v", loaded.volumes["pvc-1"].TargetPaths)
+	}
+
+	if err := loaded.removeVolume("pvc-1"); err != nil {
+		t.Fatalf("removeVolume failed: %v", err)
+	}
+	reloaded, err := loadMountState(dir)
+	if err != nil {
+		t.Fatalf("loadMountState failed: %v", err)
+	}
+	if _, ok := reloaded.getVolume("pvc-1"); ok {
+		t.Error("removed volume was persisted")
+	}
+}
+
+func TestMountStateInMemory(t *testing.T) {
+	state, err := loadMountState("")
+	if err != nil {
+		t.Fatalf("loadMountState failed: %v", err)
+	}
+	if err := state.putVolume(stagedVolume{VolumeId: "pvc-1"}); err != nil {
+		t.Fatalf("putVolume failed: %v", err)
+	}
+	if _, ok := state.getVolume("pvc-1"); !ok {
+		t.Error("volume is not kept in memory")
+	}
+}
+
+func TestLoadMountStateInvalid(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, mountStateFile), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMountState(dir); err == nil {
+		t.Error("loadMountState of an invalid state file did not fail")
+	}
+}
+
+func TestMountStateDropsConfigData(t *testing.T) {
+	dir := t.TempDir()
+	// earlier versions recorded the rclone config of the volumes
+	legacy := `{"pvc-1":{"volumeId":"pvc-1","stagingPath":"/staging","configData":"[s3]\nsecret_access_key = secret\n","parameters":{"secret":"secret"}}}`
+	if err := os.WriteFile(filepath.Join(dir, mountStateFile), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadMountState(dir)
+	if err != nil {
+		t.Fatalf("loadMountState failed: %v", err)
+	}
+	if err := state.addTarget("pvc-1", "/pods/a/mount", false); err != nil {
+		t.Fatalf("addTarget failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, mountStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("saved mount state contains the rclone config: %s", data)
+	}
+
+	out := &bytes.Buffer{}
+	if err := DumpMountState(out, dir); err != nil {
+		t.Fatalf("DumpMountState failed: %v", err)
+	}
+	if !strings.Contains(out.String(), `"refCount": 1`) {
+		t.Errorf("dump does not contain the reference count: %s", out.String())
+	}
+}
@@ -7,20 +7,27 @@ package rclone
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"gopkg.in/ini.v1"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/fernet/fernet-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/versioneer-tech/csi-rclone/pkg/kube"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
@@ -30,50 +37,283 @@ import (
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
+var (
+	vfsCacheBytes        = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "csi_rclone_vfs_cache_bytes", Help: "Bytes used by the VFS cache of the volume."}, []string{"volume_id"})
+	vfsCacheFiles        = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "csi_rclone_vfs_cache_files", Help: "Files in the VFS cache of the volume."}, []string{"volume_id"})
+	vfsUploadsInProgress = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "csi_rclone_vfs_uploads_in_progress", Help: "Uploads of the volume in progress."}, []string{"volume_id"})
+	vfsUploadsQueued     = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "csi_rclone_vfs_uploads_queued", Help: "Uploads of the volume waiting in the write-back queue."}, []string{"volume_id"})
+)
+
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
 	mounter   *mount.SafeFormatAndMount
 	RcloneOps Operations
+	// volumeLocks serialize staging and publishing of a volume, so that concurrent pods of a volume share one mount.
+	// They are taken before mutex, which is released while waiting for mounter pods.
+	volumeLocks *keyLocks
+	// mutex serializes staging and publishing on the node and guards the mount state
+	mutex sync.Mutex
+	state *mountState
+	// mounterPods runs the rclone mounts outside of the node plugin, it is nil if they run in the rclone daemon
+	mounterPods *mounterPods
+	// listings are the volume paths whose listing by volumeCondition did not return yet. A hung FUSE mount blocks
+	// it until the mount is gone, so a path is not listed again meanwhile.
+	listingMutex sync.Mutex
+	listings     map[string]bool
+	// stop is closed when the node server is stopped, so that the rclone daemon is not restarted
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 // Mounting Volume (Preparation)
+// The rclone mount of a volume is created once per node at the staging path, all pods on the node share it
+// and its VFS cache through bind mounts
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method NodeStageVolume not implemented")
+	klog.Infof("NodeStageVolume called for volume %s at %s", req.GetVolumeId(), req.GetStagingTargetPath())
+	if err := validateStageVolumeRequest(req); err != nil {
+		return nil, err
+	}
+
+	defer ns.volumeLocks.lock(req.GetVolumeId())()
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	// the secrets of the volume are usually node publish secrets, which are not passed to NodeStageVolume. the
+	// mount is then created by the first NodePublishVolume
+	if err := ns.stageVolume(ctx, req.GetVolumeId(), req.GetStagingTargetPath(), req.GetVolumeCapability(), req.GetVolumeContext(), req.GetSecrets(), false); err != nil {
+		return nil, err
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method NodeUnstageVolume not implemented")
+func validateStageVolumeRequest(req *csi.NodeStageVolumeRequest) error {
+	if req.GetVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "empty volume id")
+	}
+
+	if req.GetStagingTargetPath() == "" {
+		return status.Error(codes.InvalidArgument, "empty staging target path")
+	}
+
+	if req.GetVolumeCapability() == nil {
+		return status.Error(codes.InvalidArgument, "no volume capability set")
+	}
+	return nil
 }
 
-// Mounting Volume (Actual Mounting)
-func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	klog.Infof("NodePublishVolumeRequest=%+v", *req)
-	if err := validatePublishVolumeRequest(req); err != nil {
-		return nil, err
+// stageVolume mounts the volume at stagingPath unless it is mounted there already. If required is false, a volume
+// whose remote can't be resolved from the given secrets is left for a later call.
+func (ns *nodeServer) stageVolume(ctx context.Context, volumeId, stagingPath string, capability *csi.VolumeCapability, volumeContext, secrets map[string]string, required bool) error {
+	if volume, ok := ns.state.getVolume(volumeId); ok && volume.StagingPath == stagingPath && ns.isLiveMount(ctx, stagingPath) {
+		return nil
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(stagingPath, 0750); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		} else {
+			return status.Error(codes.Internal, err.Error())
+		}
 	}
 
-	targetPath := req.GetTargetPath()
-	volumeId := req.GetVolumeId()
-	volumeContext := req.GetVolumeContext()
-	readOnly := req.GetReadonly()
+	if !notMnt {
+		// testing original mount point, make sure the mount link is valid
+		if ns.isLiveMount(ctx, stagingPath) {
+			klog.Infof("already mounted to staging path %s", stagingPath)
+			return nil
+		}
+		// todo: mount link is invalid, now unmount and remount later (built-in functionality)
+		klog.Warningf("mount at %s is gone or not answering, unmount this directory", stagingPath)
+
+		if err := ns.mounter.Unmount(stagingPath); err != nil {
+			klog.Errorf("Unmount directory %s failed with %v", stagingPath, err)
+			return err
+		}
+	}
+
+	remote, remotePath, configData, parameters, err := resolveMount(ctx, volumeContext, secrets)
+	if err != nil {
+		return err
+	}
+	if !required && (remote == "" || configData == "") {
+		klog.Infof("no remote configuration for volume %s yet, mounting it on the first publish", volumeId)
+		return nil
+	}
+	applyVolumeUpdates(ctx, volumeId, parameters)
+	readOnly, multiWriter := false, false
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		readOnly = true
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		multiWriter = true
+		parameters[multiWriterParameter] = "true"
+	}
+
+	rcloneVol := &RcloneVolume{
+		ID:         volumeId,
+		Remote:     remote,
+		RemotePath: remotePath,
+	}
+	if ns.mounterPods != nil {
+		err = ns.mounterPods.Start(ctx, rcloneVol, stagingPath, configData, readOnly, parameters)
+		if err == nil {
+			err = ns.unlocked(func() error { return ns.mounterPods.WaitMounted(ctx, volumeId, stagingPath) })
+		}
+	} else {
+		err = ns.RcloneOps.Mount(ctx, rcloneVol, stagingPath, configData, readOnly, parameters)
+	}
+	if err != nil {
+		if os.IsPermission(err) {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+		if strings.Contains(err.Error(), "invalid argument") {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	err = ns.state.putVolume(stagedVolume{
+		VolumeId:    volumeId,
+		StagingPath: stagingPath,
+		ConfigName:  rcloneVol.deploymentName(),
+		Remote:      remote,
+		RemotePath:  remotePath,
+		ReadOnly:    readOnly,
+		MultiWriter: multiWriter,
+	})
+	if err != nil {
+		klog.Warningf("volume %s is not recovered after a restart: %v", volumeId, err)
+	}
+	return nil
+}
+
+// unlocked runs wait with the mutex of the node server released, so that a slow mount of one volume does not block
+// the others. The caller holds the lock of the volume.
+func (ns *nodeServer) unlocked(wait func() error) error {
+	ns.mutex.Unlock()
+	defer ns.mutex.Lock()
+	return wait()
+}
+
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	klog.Infof("NodeUnstageVolume called for volume %s at %s", req.GetVolumeId(), req.GetStagingTargetPath())
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume id")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty staging target path")
+	}
+
+	defer ns.volumeLocks.lock(req.GetVolumeId())()
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if ns.mounterPods != nil {
+		err := ns.mounterPods.Stop(ctx, req.GetVolumeId())
+		if err == nil {
+			err = ns.unlocked(func() error { return ns.mounterPods.WaitUnmounted(ctx, req.GetVolumeId(), stagingPath) })
+		}
+		if err != nil {
+			klog.Warningf("Unmounting volume failed: %s", err)
+		}
+	} else if ns.isRcloneMount(ctx, stagingPath) {
+		if err := ns.RcloneOps.Unmount(ctx, req.GetVolumeId(), stagingPath); err != nil {
+			klog.Warningf("Unmounting volume failed: %s", err)
+		}
+	}
+	deleteVfsMetrics(req.GetVolumeId())
+	if err := mount.CleanupMountPoint(stagingPath, ns.mounter, false); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.state.removeVolume(req.GetVolumeId()); err != nil {
+		klog.Warningf("cannot remove volume %s from the mount state: %v", req.GetVolumeId(), err)
+	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// resolveMount resolves the remote of a volume and its mount parameters from the volume context and the secrets,
+// overridden by the secret named after the PVC
+func resolveMount(ctx context.Context, volumeContext, secrets map[string]string) (string, string, string, map[string]string, error) {
 	secretName, foundSecret := volumeContext["secretName"]
 	secretNamespace, foundSecretNamespace := volumeContext["secretNamespace"]
 	var pvcSecret *v1.Secret = nil
-	var err error
 	if foundSecret && foundSecretNamespace {
+		var err error
 		pvcSecret, err = getSecret(ctx, secretNamespace, secretName)
-		if err != nil && !apierrors.IsNotFound(err) {
-			return nil, err
+		if apierrors.IsNotFound(err) {
+			pvcSecret = nil
+		} else if err != nil {
+			return "", "", "", nil, err
 		}
 	}
 
-	remote, remotePath, configData, parameters, e := extractFlags(req.GetVolumeContext(), req.GetSecrets(), pvcSecret)
+	remote, remotePath, configData, parameters, err := extractFlags(volumeContext, secrets, pvcSecret)
+	if err != nil {
+		klog.Warningf("storage parameter error: %s", err)
+		return "", "", "", nil, err
+	}
 	delete(parameters, "secretName")
 	delete(parameters, "secretNamespace")
-	if e != nil {
-		klog.Warningf("storage parameter error: %s", e)
-		return nil, e
+	return remote, remotePath, configData, parameters, nil
+}
+
+// isLiveMount reports if the volume is mounted at path and answers. A mount of the rclone daemon also has to be
+// listed by it, the mount point of a mount the daemon lost can still be readable from the kernel cache.
+func (ns *nodeServer) isLiveMount(ctx context.Context, path string) bool {
+	if !isMounted(ns.mounter, path) {
+		return false
+	}
+	return ns.mounterPods != nil || ns.isRcloneMount(ctx, path)
+}
+
+// isMounted reports if path is a mount point that can be read
+func isMounted(mounter mount.Interface, path string) bool {
+	notMnt, err := mounter.IsLikelyNotMountPoint(path)
+	if err != nil || notMnt {
+		return false
+	}
+	_, err = os.ReadDir(path)
+	return err == nil
+}
+
+// isRcloneMount reports if the rclone daemon has a mount at path
+func (ns *nodeServer) isRcloneMount(ctx context.Context, path string) bool {
+	mountPoints, err := ns.RcloneOps.ListMounts(ctx)
+	if err != nil {
+		klog.Warningf("cannot list mounts of the rclone daemon: %v", err)
+		return false
+	}
+	for _, mountPoint := range mountPoints {
+		if mountPoint.MountPoint == path {
+			return true
+		}
 	}
+	return false
+}
+
+// Mounting Volume (Actual Mounting)
+// The staged rclone mount is bind mounted to the target path of the pod
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	klog.Infof("NodePublishVolume called for %s at %s", req.GetVolumeId(), req.GetTargetPath())
+	if err := validatePublishVolumeRequest(req); err != nil {
+		return nil, err
+	}
+
+	targetPath := req.GetTargetPath()
+	stagingPath := req.GetStagingTargetPath()
+
+	defer ns.volumeLocks.lock(req.GetVolumeId())()
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if ns.state.hasTarget(req.GetVolumeId(), targetPath) && isMounted(ns.mounter, targetPath) && ns.isLiveMount(ctx, stagingPath) {
+		klog.Infof("volume %s is already published to %s", req.GetVolumeId(), targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	if err := ns.stageVolume(ctx, req.GetVolumeId(), stagingPath, req.GetVolumeCapability(), req.GetVolumeContext(), req.GetSecrets(), true); err != nil {
+		return nil, err
+	}
+
 	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -85,41 +325,28 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
-
 	if !notMnt {
-		// testing original mount point, make sure the mount link is valid
 		if _, err := os.ReadDir(targetPath); err == nil {
 			klog.Infof("already mounted to target %s", targetPath)
 			return &csi.NodePublishVolumeResponse{}, nil
 		}
-		// todo: mount link is invalid, now unmount and remount later (built-in functionality)
 		klog.Warningf("ReadDir %s failed with %v, unmount this directory", targetPath, err)
-
 		if err := ns.mounter.Unmount(targetPath); err != nil {
 			klog.Errorf("Unmount directory %s failed with %v", targetPath, err)
 			return nil, err
 		}
 	}
 
-	rcloneVol := &RcloneVolume{
-		ID:         volumeId,
-		Remote:     remote,
-		RemotePath: remotePath,
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
 	}
-	err = ns.RcloneOps.Mount(ctx, rcloneVol, targetPath, configData, readOnly, parameters)
-	if err != nil {
-		if os.IsPermission(err) {
-			return nil, status.Error(codes.PermissionDenied, err.Error())
-		}
-		if strings.Contains(err.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
-		}
-		return nil, status.Error(codes.Internal, err.Error())
+	if err := ns.mounter.Mount(stagingPath, targetPath, "", options); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot bind mount %s to %s: %v", stagingPath, targetPath, err)
+	}
+	if err := ns.state.addTarget(req.GetVolumeId(), targetPath, req.GetReadonly()); err != nil {
+		klog.Warningf("target %s of volume %s is not recovered after a restart: %v", targetPath, req.GetVolumeId(), err)
 	}
-	// err = ns.WaitForMountAvailable(targetPath)
-	// if err != nil {
-	// 	return nil, status.Error(codes.Internal, err.Error())
-	// }
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -151,6 +378,94 @@ func getPVC(ctx context.Context, namespace, name string) (*v1.PersistentVolumeCl
 	return cs.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
 }
 
+func getStorageClass(ctx context.Context, name string) (*storagev1.StorageClass, error) {
+	cs, err := kube.GetK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Failed to read StorageClass with K8s client because name is blank")
+	}
+	return cs.StorageV1().StorageClasses().Get(ctx, name, metav1.GetOptions{})
+}
+
+func getNode(ctx context.Context, name string) (*v1.Node, error) {
+	cs, err := kube.GetK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Failed to read Node with K8s client because name is blank")
+	}
+	return cs.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+}
+
+func getPV(ctx context.Context, name string) (*v1.PersistentVolume, error) {
+	cs, err := kube.GetK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Failed to read PV with K8s client because name is blank")
+	}
+	return cs.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+}
+
+// findPV returns the PV of the volume. Dynamically provisioned PVs are named after their volume, so only
+// statically provisioned ones have to be searched for.
+func findPV(ctx context.Context, volumeId string) (*v1.PersistentVolume, error) {
+	pv, err := getPV(ctx, volumeId)
+	if err == nil && pv.Spec.CSI != nil && pv.Spec.CSI.VolumeHandle == volumeId {
+		return pv, nil
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	cs, err := kube.GetK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	pvs, err := cs.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pvs.Items {
+		if pvs.Items[i].Spec.CSI != nil && pvs.Items[i].Spec.CSI.VolumeHandle == volumeId {
+			return &pvs.Items[i], nil
+		}
+	}
+	return nil, ErrVolumeNotFound
+}
+
+// applyVolumeUpdates adds the changes made to a dynamically provisioned volume after its volume context was created
+// to the mount parameters: the capacity of an expanded PV and the parameters of ControllerModifyVolume.
+func applyVolumeUpdates(ctx context.Context, volumeId string, parameters map[string]string) {
+	pv, err := getPV(ctx, volumeId)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			klog.Warningf("cannot read PV %s for updates of the volume: %v", volumeId, err)
+		}
+		return
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.VolumeHandle != volumeId {
+		return
+	}
+	if capacity := pv.Spec.Capacity[v1.ResourceStorage]; capacity.Value() > 0 {
+		parameters["capacityBytes"] = strconv.FormatInt(capacity.Value(), 10)
+	}
+	if data, ok := pv.Annotations[mutableParametersAnnotation()]; ok {
+		mutableParameters := map[string]string{}
+		if err := json.Unmarshal([]byte(data), &mutableParameters); err != nil {
+			klog.Warningf("ignoring invalid mutable parameters of PV %s: %v", volumeId, err)
+			return
+		}
+		for key, value := range mutableParameters {
+			parameters[modifiedParameterPrefix+key] = value
+		}
+	}
+}
+
 func validatePublishVolumeRequest(req *csi.NodePublishVolumeRequest) error {
 	if req.GetVolumeId() == "" {
 		return status.Error(codes.InvalidArgument, "empty volume id")
@@ -160,6 +475,10 @@ func validatePublishVolumeRequest(req *csi.NodePublishVolumeRequest) error {
 		return status.Error(codes.InvalidArgument, "empty target path")
 	}
 
+	if req.GetStagingTargetPath() == "" {
+		return status.Error(codes.InvalidArgument, "empty staging target path")
+	}
+
 	if req.GetVolumeCapability() == nil {
 		return status.Error(codes.InvalidArgument, "no volume capability set")
 	}
@@ -201,7 +520,7 @@ func extractFlags(volumeContext map[string]string, secret map[string]string, pvc
 	remotePath := flags["remotePath"]
 
 	if remotePathSuffix, ok := flags["remotePathSuffix"]; ok {
-		remotePath = remotePath + remotePathSuffix
+		remotePath = withPathSuffix(remotePath, remotePathSuffix)
 		delete(flags, "remotePathSuffix")
 	}
 
@@ -277,16 +596,20 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.InvalidArgument, "NodeUnpublishVolume Target Path must be provided")
 	}
 
-	if _, err := ns.RcloneOps.GetVolumeById(ctx, req.GetVolumeId()); err == ErrVolumeNotFound {
-		klog.Warning("VolumeId not found for NodeUnpublishVolume")
-		mount.CleanupMountPoint(req.GetTargetPath(), ns.mounter, false)
-		return &csi.NodeUnpublishVolumeResponse{}, nil
-	}
-
-	if err := ns.RcloneOps.Unmount(ctx, req.GetVolumeId(), targetPath); err != nil {
-		klog.Warningf("Unmounting volume failed: %s", err)
+	defer ns.volumeLocks.lock(req.GetVolumeId())()
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	// volumes published before staging was supported are mounted by rclone at the target path itself
+	if !ns.state.hasTarget(req.GetVolumeId(), targetPath) && ns.isRcloneMount(ctx, targetPath) {
+		if err := ns.RcloneOps.Unmount(ctx, req.GetVolumeId(), targetPath); err != nil {
+			klog.Warningf("Unmounting volume failed: %s", err)
+		}
+		deleteVfsMetrics(req.GetVolumeId())
 	}
 	mount.CleanupMountPoint(req.GetTargetPath(), ns.mounter, false)
+	if err := ns.state.removeTarget(req.GetVolumeId(), targetPath); err != nil {
+		klog.Warningf("cannot remove target %s of volume %s from the mount state: %v", targetPath, req.GetVolumeId(), err)
+	}
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -302,9 +625,205 @@ func validateUnPublishVolumeRequest(req *csi.NodeUnpublishVolumeRequest) error {
 	return nil
 }
 
+// NodeGetInfo reports the value of the topology key label of the node, so that volumes constrained to
+// a topology segment are only used on nodes in that segment
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp, err := ns.DefaultNodeServer.NodeGetInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	key := topologyKey()
+	if key == "" {
+		return resp, nil
+	}
+	node, err := getNode(ctx, resp.NodeId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot read node %s: %v", resp.NodeId, err)
+	}
+	value, ok := node.Labels[key]
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s has no label %s", resp.NodeId, key)
+	}
+	resp.AccessibleTopology = &csi.Topology{Segments: map[string]string{key: value}}
+	return resp, nil
+}
+
+func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: newNodeServiceCapabilities(
+			csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+			csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+			csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+			csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+		),
+	}, nil
+}
+
+// mountResponseTimeout is how long a FUSE mount may take to list its root before it is considered dead
+const mountResponseTimeout = 5 * time.Second
+
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume id")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume path")
+	}
+	if _, err := os.Stat(volumePath); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume path %s not found", volumePath)
+	}
+
+	// the rclone mount is at the staging path, the volume path is a bind mount of it
+	mountPath := req.GetStagingTargetPath()
+	if mountPath == "" {
+		mountPath = volumePath
+	}
+	mount, condition := ns.volumeCondition(ctx, mountPath, volumePath)
+	if condition.Abnormal {
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(volumePath, &stat); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot stat filesystem of %s: %v", volumePath, err)
+	}
+	blockSize := int64(stat.Bsize)
+	usage := []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(stat.Blocks) * blockSize,
+			Available: int64(stat.Bavail) * blockSize,
+			Used:      int64(stat.Blocks-stat.Bfree) * blockSize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(stat.Files),
+			Available: int64(stat.Ffree),
+			Used:      int64(stat.Files - stat.Ffree),
+		},
+	}
+	if mount != nil {
+		ns.updateVfsMetrics(ctx, req.GetVolumeId(), mount)
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: condition,
+	}, nil
+}
+
+// updateVfsMetrics exposes the occupancy of the VFS cache and the write-back queue of the mount as metrics
+func (ns *nodeServer) updateVfsMetrics(ctx context.Context, volumeId string, mount *MountPoint) {
+	stats, err := ns.RcloneOps.VfsStats(ctx, mount.Fs)
+	if err != nil {
+		klog.Warningf("cannot get vfs stats of volume %s: %v", volumeId, err)
+		return
+	}
+	if stats.DiskCache == nil {
+		deleteVfsMetrics(volumeId)
+		return
+	}
+	vfsCacheBytes.WithLabelValues(volumeId).Set(float64(stats.DiskCache.BytesUsed))
+	vfsCacheFiles.WithLabelValues(volumeId).Set(float64(stats.DiskCache.Files))
+	vfsUploadsInProgress.WithLabelValues(volumeId).Set(float64(stats.DiskCache.UploadsInProgress))
+	vfsUploadsQueued.WithLabelValues(volumeId).Set(float64(stats.DiskCache.UploadsQueued))
+}
+
+func deleteVfsMetrics(volumeId string) {
+	vfsCacheBytes.DeleteLabelValues(volumeId)
+	vfsCacheFiles.DeleteLabelValues(volumeId)
+	vfsUploadsInProgress.DeleteLabelValues(volumeId)
+	vfsUploadsQueued.DeleteLabelValues(volumeId)
+}
+
+// volumeCondition reports a volume as abnormal if its mount is not registered in the rclone daemon or the volume
+// does not answer. Mounts of mounter pods are not known to the daemon and have no MountPoint.
+func (ns *nodeServer) volumeCondition(ctx context.Context, mountPath, volumePath string) (*MountPoint, *csi.VolumeCondition) {
+	var mount *MountPoint
+	if ns.mounterPods == nil {
+		mountPoints, err := ns.RcloneOps.ListMounts(ctx)
+		if err != nil {
+			return nil, &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("cannot list mounts of the rclone daemon: %v", err)}
+		}
+		for i := range mountPoints {
+			if mountPoints[i].MountPoint == mountPath {
+				mount = &mountPoints[i]
+				break
+			}
+		}
+		if mount == nil {
+			return nil, &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("%s is not mounted by the rclone daemon", mountPath)}
+		}
+	}
+
+	listed, ok := ns.listVolume(volumePath)
+	if !ok {
+		return mount, &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("mount %s did not answer an earlier listing yet", volumePath)}
+	}
+	select {
+	case err := <-listed:
+		if err != nil {
+			return mount, &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("cannot list mount %s: %v", volumePath, err)}
+		}
+	case <-time.After(mountResponseTimeout):
+		return mount, &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("mount %s did not answer within %s", volumePath, mountResponseTimeout)}
+	}
+	return mount, &csi.VolumeCondition{Abnormal: false, Message: "volume is mounted"}
+}
+
+// listVolume lists volumePath in the background and returns the channel that receives the result. It returns false
+// while an earlier listing of volumePath did not return yet.
+func (ns *nodeServer) listVolume(volumePath string) (<-chan error, bool) {
+	ns.listingMutex.Lock()
+	defer ns.listingMutex.Unlock()
+	if ns.listings[volumePath] {
+		return nil, false
+	}
+	ns.listings[volumePath] = true
+	listed := make(chan error, 1)
+	go func() {
+		_, err := os.ReadDir(volumePath)
+		ns.listingMutex.Lock()
+		delete(ns.listings, volumePath)
+		ns.listingMutex.Unlock()
+		listed <- err
+	}()
+	return listed, true
+}
+
+func newNodeServiceCapabilities(types ...csi.NodeServiceCapability_RPC_Type) []*csi.NodeServiceCapability {
+	capabilities := make([]*csi.NodeServiceCapability, 0, len(types))
+	for _, t := range types {
+		capabilities = append(capabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{Type: t},
+			},
+		})
+	}
+	return capabilities
+}
+
 // Resizing Volume
+// The size of a mount can't be changed while it is mounted, the new size of the PV is used when the volume is
+// staged on the node the next time
 func (*nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method NodeExpandVolume not implemented")
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume id")
+	}
+	if req.GetVolumePath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty volume path")
+	}
+	if _, err := os.Stat(req.GetVolumePath()); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s not found", req.GetVolumePath())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	klog.Infof("volume %s expanded to %d bytes, the new size is reported after the volume is staged on this node the next time", req.GetVolumeId(), req.GetCapacityRange().GetRequiredBytes())
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+	}, nil
 }
 
 func (ns *nodeServer) WaitForMountAvailable(mountpoint string) error {
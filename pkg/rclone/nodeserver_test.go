@@ -0,0 +1,27 @@
+package rclone
+
+import "testing"
+
+func TestListVolumeInFlight(t *testing.T) {
+	ns := &nodeServer{listings: map[string]bool{}}
+	path := t.TempDir()
+	// a listing that hangs on a dead mount is not started again
+	ns.listings[path] = true
+	if _, ok := ns.listVolume(path); ok {
+		t.Fatal("path was listed again while an earlier listing did not return")
+	}
+
+	delete(ns.listings, path)
+	listed, ok := ns.listVolume(path)
+	if !ok {
+		t.Fatal("path without a listing in flight was not listed")
+	}
+	if err := <-listed; err != nil {
+		t.Errorf("listing failed: %v", err)
+	}
+	ns.listingMutex.Lock()
+	defer ns.listingMutex.Unlock()
+	if ns.listings[path] {
+		t.Error("returned listing is still in flight")
+	}
+}
@@ -0,0 +1,232 @@
+// Package rc is a client for the remote control API of an rclone daemon, see https://rclone.org/rc/. Every call
+// honours the context of the request it is made for, is limited by a timeout and is retried if the daemon can't
+// be reached, e.g. while it is restarted.
+
+package rc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog"
+)
+
+const (
+	// DefaultTimeout limits a single call, mounting waits for the remote to be listed
+	DefaultTimeout = time.Minute
+	// DefaultRetries is how often a call is repeated if the daemon can't be reached
+	DefaultRetries = 3
+
+	retryInterval = 500 * time.Millisecond
+)
+
+type Client struct {
+	httpClient *http.Client
+	user       string
+	pass       string
+	Timeout    time.Duration
+	Retries    int
+}
+
+// NewUnixClient returns a client for a daemon listening on the unix socket at socketPath. The credentials are
+// sent with every call, rclone requires them for the calls that access remotes.
+func NewUnixClient(socketPath, user, pass string) *Client {
+	dialer := &net.Dialer{}
+	return &Client{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+		user:    user,
+		pass:    pass,
+		Timeout: DefaultTimeout,
+		Retries: DefaultRetries,
+	}
+}
+
+// Error is an error returned by the daemon, in the format of https://rclone.org/rc/#error-returns. The input of
+// the call is left out as it can contain credentials in plain text.
+type Error struct {
+	Message string `json:"error"`
+	Path    string `json:"path"`
+	Status  int    `json:"status"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("received error from the rclone server: {%q: %q, %q: %q, %q: %q, %q: %d}",
+		"error", e.Message, "path", e.Path, "input", "<redacted>", "status", e.Status)
+}
+
+// Call posts in as JSON to path and decodes the response into out unless it is nil
+func (c *Client) Call(ctx context.Context, path string, in, out interface{}) error {
+	if in == nil {
+		in = struct{}{}
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't create request body: %s", path, err)
+	}
+	for attempt := 0; ; attempt++ {
+		err = c.call(ctx, path, body, out)
+		if err == nil || !isUnreachable(err) || attempt >= c.Retries {
+			return err
+		}
+		klog.Warningf("rclone daemon is not reachable for %s, retrying: %v", path, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retryInterval << attempt):
+		}
+	}
+}
+
+func (c *Client) call(ctx context.Context, path string, body []byte, out interface{}) error {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://rclone/"+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%s: couldn't create request: %w", path, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.user, c.pass)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: couldn't send HTTP request: %w", path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		// NOTE: do not wrap the error in case it contains sensitive information from the body
+		return fmt.Errorf("%s: could not read the response body from the rclone server", path)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		result := &Error{}
+		if err := json.Unmarshal(data, result); err != nil {
+			// NOTE: do not wrap the error in case it contains sensitive information from the body
+			return fmt.Errorf("%s: could not unmarshal the error response from the rclone server", path)
+		}
+		if result.Message == "" {
+			return fmt.Errorf("%s: unmarshalled the response from the server but it had nothing in the error field", path)
+		}
+		if result.Status == 0 {
+			result.Status = resp.StatusCode
+		}
+		return fmt.Errorf("%s: %w", path, result)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%s: couldn't decode response: %w", path, err)
+	}
+	return nil
+}
+
+// isUnreachable reports if the request did not reach the daemon, so that it is safe to send it again
+func isUnreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// ConfigCreate creates the remote req.Name, see https://rclone.org/rc/#config-create
+func (c *Client) ConfigCreate(ctx context.Context, req ConfigCreateRequest) error {
+	return c.Call(ctx, "config/create", req, nil)
+}
+
+// ConfigUpdate changes parameters of the remote req.Name, see https://rclone.org/rc/#config-update
+func (c *Client) ConfigUpdate(ctx context.Context, req ConfigUpdateRequest) error {
+	return c.Call(ctx, "config/update", req, nil)
+}
+
+// ConfigDelete deletes the remote name, see https://rclone.org/rc/#config-delete
+func (c *Client) ConfigDelete(ctx context.Context, name string) error {
+	return c.Call(ctx, "config/delete", ConfigDeleteRequest{Name: name}, nil)
+}
+
+// Mount mounts req.Fs at req.MountPoint, see https://rclone.org/rc/#mount-mount
+func (c *Client) Mount(ctx context.Context, req MountRequest) error {
+	return c.Call(ctx, "mount/mount", req, nil)
+}
+
+// Unmount unmounts the mount at mountPoint, see https://rclone.org/rc/#mount-unmount
+func (c *Client) Unmount(ctx context.Context, mountPoint string) error {
+	return c.Call(ctx, "mount/unmount", UnmountRequest{MountPoint: mountPoint}, nil)
+}
+
+// ListMounts returns the mounts of the daemon, see https://rclone.org/rc/#mount-listmounts
+func (c *Client) ListMounts(ctx context.Context) ([]MountPoint, error) {
+	var result ListMountsResponse
+	if err := c.Call(ctx, "mount/listmounts", nil, &result); err != nil {
+		return nil, err
+	}
+	return result.MountPoints, nil
+}
+
+// VfsList returns the active VFSes, see https://rclone.org/rc/#vfs-list
+func (c *Client) VfsList(ctx context.Context) ([]string, error) {
+	var result VfsListResponse
+	if err := c.Call(ctx, "vfs/list", nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Vfses, nil
+}
+
+// VfsStats returns the statistics of the VFS of fs, see https://rclone.org/rc/#vfs-stats
+func (c *Client) VfsStats(ctx context.Context, fs string) (*VfsStatsResponse, error) {
+	var result VfsStatsResponse
+	if err := c.Call(ctx, "vfs/stats", VfsRequest{Fs: fs}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// VfsRefresh reads the directory tree of the VFS into the directory cache, see https://rclone.org/rc/#vfs-refresh
+func (c *Client) VfsRefresh(ctx context.Context, req VfsRefreshRequest) error {
+	return c.Call(ctx, "vfs/refresh", req, nil)
+}
+
+// VfsForget drops the directory cache of the VFS of fs, see https://rclone.org/rc/#vfs-forget
+func (c *Client) VfsForget(ctx context.Context, fs string) error {
+	return c.Call(ctx, "vfs/forget", VfsRequest{Fs: fs}, nil)
+}
+
+// Noop answers if the daemon is up, see https://rclone.org/rc/#rc-noop
+func (c *Client) Noop(ctx context.Context) error {
+	return c.Call(ctx, "rc/noop", nil, nil)
+}
+
+// Version returns the version of the daemon, see https://rclone.org/rc/#core-version
+func (c *Client) Version(ctx context.Context) (*VersionResponse, error) {
+	var result VersionResponse
+	if err := c.Call(ctx, "core/version", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Stats returns the transfer statistics of the daemon, see https://rclone.org/rc/#core-stats
+func (c *Client) Stats(ctx context.Context) (*StatsResponse, error) {
+	var result StatsResponse
+	if err := c.Call(ctx, "core/stats", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Quit stops the daemon, see https://rclone.org/rc/#core-quit
+func (c *Client) Quit(ctx context.Context) error {
+	return c.Call(ctx, "core/quit", nil, nil)
+}
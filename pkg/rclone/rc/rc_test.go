@@ -0,0 +1,198 @@
+package rc
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	testUser = "csi-rclone"
+	testPass = "0123456789abcdef"
+)
+
+func newTestClient(socketPath string) *Client {
+	return NewUnixClient(socketPath, testUser, testPass)
+}
+
+// serveUnix serves handler on a unix socket at socketPath, like the rclone daemon does. Like rclone with
+// --rc-user and --rc-pass it refuses calls without the credentials.
+func serveUnix(t *testing.T, socketPath string, handler http.Handler) {
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Errorf("cannot listen on %s: %v", socketPath, err)
+		return
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != testUser || pass != testPass {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"authentication must be set up on the rc server to use \"mount/mount\" or the --rc-no-auth flag must be in use","status":401}`))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+}
+
+func TestCallRetriesUntilDaemonListens(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "rc.sock")
+	var gotPath, gotBody string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("cannot read request: %v", err)
+		}
+		gotPath, gotBody = r.URL.Path, string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"mountPoints":[{"Fs":"s3:bucket","MountPoint":"/staging"}]}`))
+	})
+	// the socket only appears once the daemon is up
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		time.Sleep(retryInterval / 2)
+		serveUnix(t, socketPath, handler)
+	}()
+	t.Cleanup(func() { <-started })
+
+	client := newTestClient(socketPath)
+	mountPoints, err := client.ListMounts(context.Background())
+	if err != nil {
+		t.Fatalf("ListMounts failed: %v", err)
+	}
+	if len(mountPoints) != 1 || mountPoints[0].Fs != "s3:bucket" || mountPoints[0].MountPoint != "/staging" {
+		t.Errorf("ListMounts = %+v", mountPoints)
+	}
+	if gotPath != "/mount/listmounts" || gotBody != "{}" {
+		t.Errorf("daemon received %s with body %s", gotPath, gotBody)
+	}
+}
+
+func TestCallGivesUpWhenUnreachable(t *testing.T) {
+	client := newTestClient(filepath.Join(t.TempDir(), "rc.sock"))
+	client.Retries = 1
+	err := client.Noop(context.Background())
+	if err == nil {
+		t.Fatal("call without a daemon did not fail")
+	}
+	if !isUnreachable(err) {
+		t.Errorf("error of a call without a daemon is not a dial error: %v", err)
+	}
+}
+
+func TestCallDoesNotRetryErrors(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "rc.sock")
+	calls := 0
+	serveUnix(t, socketPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"mount failed","path":"mount/mount","status":500}`))
+	}))
+	client := newTestClient(socketPath)
+	if err := client.Mount(context.Background(), MountRequest{Fs: "s3:bucket", MountPoint: "/staging"}); err == nil {
+		t.Fatal("failed mount did not return an error")
+	}
+	if calls != 1 {
+		t.Errorf("daemon was called %d times, want 1", calls)
+	}
+}
+
+func TestCallDecodesErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		want       *Error
+	}{
+		{name: "status of the error", statusCode: http.StatusInternalServerError,
+			body: `{"error":"directory not found","path":"mount/mount","input":{"fs":"s3:bucket","secret_access_key":"secret"},"status":404}`,
+			want: &Error{Message: "directory not found", Path: "mount/mount", Status: http.StatusNotFound}},
+		{name: "status of the response", statusCode: http.StatusBadRequest,
+			body: `{"error":"mountPoint is required","path":"mount/mount"}`,
+			want: &Error{Message: "mountPoint is required", Path: "mount/mount", Status: http.StatusBadRequest}},
+		{name: "empty error", statusCode: http.StatusInternalServerError, body: `{"path":"mount/mount"}`},
+		{name: "invalid body", statusCode: http.StatusInternalServerError, body: `secret_access_key = secret`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			socketPath := filepath.Join(t.TempDir(), "rc.sock")
+			serveUnix(t, socketPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.statusCode)
+				w.Write([]byte(test.body))
+			}))
+			client := newTestClient(socketPath)
+			err := client.Mount(context.Background(), MountRequest{Fs: "s3:bucket", MountPoint: "/staging"})
+			if err == nil {
+				t.Fatal("call did not fail")
+			}
+			if strings.Contains(err.Error(), "secret") {
+				t.Errorf("error contains the input of the call: %v", err)
+			}
+			var rcErr *Error
+			if test.want == nil {
+				if errors.As(err, &rcErr) {
+					t.Errorf("got rc error %+v, want none", rcErr)
+				}
+				return
+			}
+			if !errors.As(err, &rcErr) {
+				t.Fatalf("error is not an rc error: %v", err)
+			}
+			if *rcErr != *test.want {
+				t.Errorf("got rc error %+v, want %+v", rcErr, test.want)
+			}
+			if !strings.Contains(err.Error(), `"input": "<redacted>"`) {
+				t.Errorf("error does not redact the input: %v", err)
+			}
+		})
+	}
+}
+
+func TestCallEncodesRequest(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "rc.sock")
+	var got MountRequest
+	serveUnix(t, socketPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s request with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("cannot decode request: %v", err)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	client := newTestClient(socketPath)
+	req := MountRequest{Fs: "s3:bucket", MountPoint: "/staging", VfsOpt: VfsOpt{CacheMode: "writes"}}
+	if err := client.Mount(context.Background(), req); err != nil {
+		t.Fatalf("Mount failed: %v", err)
+	}
+	if got.Fs != req.Fs || got.MountPoint != req.MountPoint || got.VfsOpt.CacheMode != "writes" {
+		t.Errorf("daemon received %+v, want %+v", got, req)
+	}
+}
+
+func TestCallSendsCredentials(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "rc.sock")
+	serveUnix(t, socketPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	if err := newTestClient(socketPath).Mount(context.Background(), MountRequest{Fs: "s3:bucket", MountPoint: "/staging"}); err != nil {
+		t.Fatalf("call with credentials failed: %v", err)
+	}
+
+	err := NewUnixClient(socketPath, testUser, "wrong").Mount(context.Background(), MountRequest{Fs: "s3:bucket", MountPoint: "/staging"})
+	var rcErr *Error
+	if !errors.As(err, &rcErr) || rcErr.Status != http.StatusUnauthorized {
+		t.Errorf("call with wrong credentials returned %v, want an rc error with status 401", err)
+	}
+}
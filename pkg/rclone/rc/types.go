@@ -0,0 +1,149 @@
+package rc
+
+import (
+	"os"
+	"time"
+)
+
+// ConfigCreateRequest is the input of config/create, see https://rclone.org/rc/#config-create
+type ConfigCreateRequest struct {
+	Name        string                 `json:"name"`
+	Parameters  map[string]string      `json:"parameters"`
+	StorageType string                 `json:"type"`
+	Opt         map[string]interface{} `json:"opt"`
+}
+
+// ConfigUpdateRequest is the input of config/update, see https://rclone.org/rc/#config-update
+type ConfigUpdateRequest struct {
+	Name       string                 `json:"name"`
+	Parameters map[string]string      `json:"parameters"`
+	Opt        map[string]interface{} `json:"opt"`
+}
+
+type ConfigDeleteRequest struct {
+	Name string `json:"name"`
+}
+
+// MountRequest is the input of mount/mount, see https://rclone.org/rc/#mount-mount
+type MountRequest struct {
+	Fs         string   `json:"fs"`
+	MountPoint string   `json:"mountPoint"`
+	VfsOpt     VfsOpt   `json:"vfsOpt"`
+	MountOpt   MountOpt `json:"mountOpt"`
+}
+
+type VfsOpt struct {
+	NoSeek             bool          `json:"noSeek,omitempty"`
+	NoChecksum         bool          `json:"noChecksum,omitempty"`
+	ReadOnly           bool          `json:"readOnly,omitempty"`
+	NoModTime          bool          `json:"noModTime,omitempty"`
+	DirCacheTime       time.Duration `json:"dirCacheTime,omitempty"`
+	Refresh            bool          `json:"refresh,omitempty"`
+	PollInterval       time.Duration `json:"pollInterval,omitempty"`
+	Umask              int           `json:"umask,omitempty"`
+	UID                uint32        `json:"uid,omitempty"`
+	GID                uint32        `json:"gid,omitempty"`
+	DirPerms           os.FileMode   `json:"dirPerms,omitempty"`
+	FilePerms          os.FileMode   `json:"filePerms,omitempty"`
+	ChunkSize          int64         `json:"chunkSize,omitempty"`
+	ChunkSizeLimit     int64         `json:"chunkSizeLimit,omitempty"`
+	CacheMode          string        `json:"cacheMode,omitempty"`
+	CacheMaxAge        time.Duration `json:"cacheMaxAge,omitempty"`
+	CacheMaxSize       int64         `json:"cacheMaxSize,omitempty"`
+	CacheMinFreeSpace  int64         `json:"cacheMinFreeSpace,omitempty"`
+	CachePollInterval  time.Duration `json:"cachePollInterval,omitempty"`
+	CaseInsensitive    bool          `json:"caseInsensitive,omitempty"`
+	WriteWait          time.Duration `json:"writeWait,omitempty"`
+	ReadWait           time.Duration `json:"readWait,omitempty"`
+	WriteBack          time.Duration `json:"writeBack,omitempty"`
+	ReadAhead          int64         `json:"readAhead,omitempty"`
+	UsedIsSize         bool          `json:"usedIsSize,omitempty"`
+	FastFingerprint    bool          `json:"fastFingerprint,omitempty"`
+	DiskSpaceTotalSize int64         `json:"diskSpaceTotalSize,omitempty"`
+}
+
+type MountOpt struct {
+	DebugFUSE          bool          `json:"debugFUSE,omitempty"`
+	AllowNonEmpty      bool          `json:"allowNonEmpty,omitempty"`
+	AllowRoot          bool          `json:"allowRoot,omitempty"`
+	AllowOther         bool          `json:"allowOther,omitempty"`
+	DefaultPermissions bool          `json:"defaultPermissions,omitempty"`
+	WritebackCache     bool          `json:"writebackCache,omitempty"`
+	DaemonWait         time.Duration `json:"daemonWait,omitempty"`
+	MaxReadAhead       int64         `json:"maxReadAhead,omitempty"`
+	ExtraOptions       []string      `json:"extraOptions,omitempty"`
+	ExtraFlags         []string      `json:"extraFlags,omitempty"`
+	AttrTimeout        time.Duration `json:"attrTimeout,omitempty"`
+	DeviceName         string        `json:"deviceName,omitempty"`
+	VolumeName         string        `json:"volumeName,omitempty"`
+	NoAppleDouble      bool          `json:"noAppleDouble,omitempty"`
+	NoAppleXattr       bool          `json:"noAppleXattr,omitempty"`
+	AsyncRead          bool          `json:"asyncRead,omitempty"`
+	CaseInsensitive    string        `json:"caseInsensitive,omitempty"`
+}
+
+type UnmountRequest struct {
+	MountPoint string `json:"mountPoint"`
+}
+
+type ListMountsResponse struct {
+	MountPoints []MountPoint `json:"mountPoints"`
+}
+
+type MountPoint struct {
+	Fs         string `json:"Fs"`
+	MountPoint string `json:"MountPoint"`
+}
+
+// VfsRequest selects the VFS of the vfs/* calls, it can be omitted if there is only one
+type VfsRequest struct {
+	Fs string `json:"fs,omitempty"`
+}
+
+type VfsListResponse struct {
+	Vfses []string `json:"vfses"`
+}
+
+// VfsStatsResponse is the part of the vfs/stats response we are interested in, DiskCache is only
+// set for mounts with a cache mode other than off
+type VfsStatsResponse struct {
+	DiskCache *VfsDiskCacheStats `json:"diskCache,omitempty"`
+}
+
+type VfsDiskCacheStats struct {
+	BytesUsed         int64 `json:"bytesUsed"`
+	Files             int64 `json:"files"`
+	UploadsInProgress int64 `json:"uploadsInProgress"`
+	UploadsQueued     int64 `json:"uploadsQueued"`
+}
+
+// VfsRefreshRequest is the input of vfs/refresh, dirs are given as dir, dir2, ... relative to the root of the VFS
+type VfsRefreshRequest struct {
+	Fs        string `json:"fs,omitempty"`
+	Dir       string `json:"dir,omitempty"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+
+// VersionResponse is the part of the core/version response we are interested in
+type VersionResponse struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Os        string `json:"os"`
+	Arch      string `json:"arch"`
+}
+
+// StatsResponse is the part of the core/stats response we are interested in
+type StatsResponse struct {
+	Bytes          int64   `json:"bytes"`
+	Errors         int64   `json:"errors"`
+	Transfers      int64   `json:"transfers"`
+	Checks         int64   `json:"checks"`
+	Speed          float64 `json:"speed"`
+	ElapsedTime    float64 `json:"elapsedTime"`
+	RetryError     bool    `json:"retryError"`
+	FatalError     bool    `json:"fatalError"`
+	LastError      string  `json:"lastError,omitempty"`
+	Renames        int64   `json:"renames"`
+	Deletes        int64   `json:"deletes"`
+	ServerSideCopy int64   `json:"serverSideCopies"`
+}
@@ -3,19 +3,26 @@ package rclone
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	os_exec "os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/versioneer-tech/csi-rclone/pkg/rclone/rc"
 	"golang.org/x/net/context"
 	"gopkg.in/ini.v1"
+	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -30,6 +37,14 @@ var (
 type Operations interface {
 	CreateVol(ctx context.Context, volumeName, remote, remotePath, rcloneConfigPath string, parameters map[string]string) error
 	DeleteVol(ctx context.Context, rcloneVolume *RcloneVolume, rcloneConfigPath string, parameters map[string]string) error
+	MoveVol(ctx context.Context, rcloneVolume *RcloneVolume, remotePath, rcloneConfigPath string) error
+	CopyVol(ctx context.Context, source, target *RcloneVolume, rcloneConfigPath string, excludes ...string) error
+	Size(ctx context.Context, rcloneVolume *RcloneVolume, rcloneConfigPath string) (int64, error)
+	About(ctx context.Context, remote, remotePath, rcloneConfigPath string) (*AboutResponse, error)
+	Probe(ctx context.Context, rcloneVolume *RcloneVolume, rcloneConfigPath string) error
+	ListMounts(ctx context.Context) ([]MountPoint, error)
+	VfsStats(ctx context.Context, fs string) (*VfsStatsResponse, error)
+	ListDirs(ctx context.Context, remote, remotePath, rcloneConfigPath string) ([]string, error)
 	Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPath string, rcloneConfigData string, readOnly bool, parameters map[string]string) error
 	Unmount(ctx context.Context, volumeId string, targetPath string) error
 	GetVolumeById(ctx context.Context, volumeId string) (*RcloneVolume, error)
@@ -39,9 +54,22 @@ type Operations interface {
 
 type Rclone struct {
 	execute    exec.Interface
-	kubeClient *kubernetes.Clientset
-	daemonCmd  *os_exec.Cmd
-	port       int
+	kubeClient kubernetes.Interface
+	daemon     *daemonProcess
+	configs    *configRefs
+	// the rc API of the daemon is only reachable through a unix socket that only the node plugin can access, and
+	// requires credentials generated on every start of the plugin for the calls that access remotes
+	socketPath string
+	rcPass     string
+	rc         *rc.Client
+}
+
+// daemonProcess is the rclone daemon, which is started by Run and killed by Cleanup from another goroutine
+type daemonProcess struct {
+	mutex sync.Mutex
+	cmd   *os_exec.Cmd
+	// stopped is set by Cleanup, the daemon is not started again after that
+	stopped bool
 }
 
 type RcloneVolume struct {
@@ -49,88 +77,133 @@ type RcloneVolume struct {
 	RemotePath string
 	ID         string
 }
-type MountRequest struct {
-	Fs         string   `json:"fs"`
-	MountPoint string   `json:"mountPoint"`
-	VfsOpt     VfsOpt   `json:"vfsOpt"`
-	MountOpt   MountOpt `json:"mountOpt"`
-}
-
-type VfsOpt struct {
-	NoSeek             bool          `json:"noSeek,omitempty"`
-	NoChecksum         bool          `json:"noChecksum,omitempty"`
-	ReadOnly           bool          `json:"readOnly,omitempty"`
-	NoModTime          bool          `json:"noModTime,omitempty"`
-	DirCacheTime       time.Duration `json:"dirCacheTime,omitempty"`
-	Refresh            bool          `json:"refresh,omitempty"`
-	PollInterval       time.Duration `json:"pollInterval,omitempty"`
-	Umask              int           `json:"umask,omitempty"`
-	UID                uint32        `json:"uid,omitempty"`
-	GID                uint32        `json:"gid,omitempty"`
-	DirPerms           os.FileMode   `json:"dirPerms,omitempty"`
-	FilePerms          os.FileMode   `json:"filePerms,omitempty"`
-	ChunkSize          int64         `json:"chunkSize,omitempty"`
-	ChunkSizeLimit     int64         `json:"chunkSizeLimit,omitempty"`
-	CacheMode          string        `json:"cacheMode,omitempty"`
-	CacheMaxAge        time.Duration `json:"cacheMaxAge,omitempty"`
-	CacheMaxSize       int64         `json:"cacheMaxSize,omitempty"`
-	CacheMinFreeSpace  int64         `json:"cacheMinFreeSpace,omitempty"`
-	CachePollInterval  time.Duration `json:"cachePollInterval,omitempty"`
-	CaseInsensitive    bool          `json:"caseInsensitive,omitempty"`
-	WriteWait          time.Duration `json:"writeWait,omitempty"`
-	ReadWait           time.Duration `json:"readWait,omitempty"`
-	WriteBack          time.Duration `json:"writeBack,omitempty"`
-	ReadAhead          int64         `json:"readAhead,omitempty"`
-	UsedIsSize         bool          `json:"usedIsSize,omitempty"`
-	FastFingerprint    bool          `json:"fastFingerprint,omitempty"`
-	DiskSpaceTotalSize int64         `json:"diskSpaceTotalSize,omitempty"`
-}
-
-type MountOpt struct {
-	DebugFUSE          bool          `json:"debugFUSE,omitempty"`
-	AllowNonEmpty      bool          `json:"allowNonEmpty,omitempty"`
-	AllowRoot          bool          `json:"allowRoot,omitempty"`
-	AllowOther         bool          `json:"allowOther,omitempty"`
-	DefaultPermissions bool          `json:"defaultPermissions,omitempty"`
-	WritebackCache     bool          `json:"writebackCache,omitempty"`
-	DaemonWait         time.Duration `json:"daemonWait,omitempty"`
-	MaxReadAhead       int64         `json:"maxReadAhead,omitempty"`
-	ExtraOptions       []string      `json:"extraOptions,omitempty"`
-	ExtraFlags         []string      `json:"extraFlags,omitempty"`
-	AttrTimeout        time.Duration `json:"attrTimeout,omitempty"`
-	DeviceName         string        `json:"deviceName,omitempty"`
-	VolumeName         string        `json:"volumeName,omitempty"`
-	NoAppleDouble      bool          `json:"noAppleDouble,omitempty"`
-	NoAppleXattr       bool          `json:"noAppleXattr,omitempty"`
-	AsyncRead          bool          `json:"asyncRead,omitempty"`
-	CaseInsensitive    string        `json:"caseInsensitive,omitempty"`
-}
-
-type ConfigCreateRequest struct {
-	Name        string                 `json:"name"`
-	Parameters  map[string]string      `json:"parameters"`
-	StorageType string                 `json:"type"`
-	Opt         map[string]interface{} `json:"opt"`
-}
-
-type UnmountRequest struct {
-	MountPoint string `json:"mountPoint"`
-}
-type ConfigDeleteRequest struct {
-	Name string `json:"name"`
+
+// the types of the rc API used by the driver
+type (
+	VfsOpt           = rc.VfsOpt
+	MountOpt         = rc.MountOpt
+	MountPoint       = rc.MountPoint
+	VfsStatsResponse = rc.VfsStatsResponse
+)
+
+// modifiedParameterPrefix marks mount parameters changed by ControllerModifyVolume, they are applied on top
+// of the parameters of the StorageClass
+const modifiedParameterPrefix = "modified."
+
+// mutableParametersAnnotation is the PV annotation holding the parameters changed by ControllerModifyVolume
+func mutableParametersAnnotation() string {
+	return fmt.Sprintf("%s/mutable-parameters", os.Getenv("DRIVER_NAME"))
 }
 
-func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPath, rcloneConfigData string, readOnly bool, parameters map[string]string) error {
-	configName := rcloneVolume.deploymentName()
-	cfg, err := ini.Load([]byte(rcloneConfigData))
+// decodeStrict unmarshals the JSON data into v and fails on fields that v does not have
+func decodeStrict(data string, v interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// validateMountOption checks that value of the vfsOpt or mountOpt parameter key can be used for mounting
+func validateMountOption(key, value string) error {
+	switch key {
+	case "vfsOpt":
+		var vfsOpt VfsOpt
+		if err := decodeStrict(value, &vfsOpt); err != nil {
+			return fmt.Errorf("cannot parse %s: %w", key, err)
+		}
+		switch vfsOpt.CacheMode {
+		case "", "off", "minimal", "writes", "full":
+		default:
+			return fmt.Errorf("unknown cacheMode %q in %s, expected one of off, minimal, writes or full", vfsOpt.CacheMode, key)
+		}
+	case "mountOpt":
+		if err := decodeStrict(value, &MountOpt{}); err != nil {
+			return fmt.Errorf("cannot parse %s: %w", key, err)
+		}
+	default:
+		return fmt.Errorf("unknown mount option %s", key)
+	}
+	return nil
+}
+
+// mountOptions merges the vfsOpt and mountOpt parameters and the ones changed by ControllerModifyVolume
+// over the defaults of the driver
+func mountOptions(parameters map[string]string, readOnly bool) (VfsOpt, MountOpt, error) {
+	vfsOpt := VfsOpt{
+		CacheMode:    "writes",
+		DirCacheTime: 60 * time.Second,
+	}
+	for _, key := range []string{"vfsOpt", modifiedParameterPrefix + "vfsOpt"} {
+		if vfsOptStr := parameters[key]; vfsOptStr != "" {
+			if err := json.Unmarshal([]byte(vfsOptStr), &vfsOpt); err != nil {
+				return vfsOpt, MountOpt{}, fmt.Errorf("could not parse %s: %w", key, err)
+			}
+		}
+	}
+	// a read-only publication can't be made writable by the parameters
+	if readOnly {
+		vfsOpt.ReadOnly = true
+	}
+	// the size requested for the PVC is reported as the size of the filesystem unless configured explicitly
+	if vfsOpt.DiskSpaceTotalSize == 0 && parameters["capacityBytes"] != "" {
+		var err error
+		if vfsOpt.DiskSpaceTotalSize, err = strconv.ParseInt(parameters["capacityBytes"], 10, 64); err != nil {
+			return vfsOpt, MountOpt{}, fmt.Errorf("could not parse capacityBytes: %w", err)
+		}
+	}
+
+	mountOpt := MountOpt{
+		AllowNonEmpty: true,
+		AllowOther:    true,
+	}
+	for _, key := range []string{"mountOpt", modifiedParameterPrefix + "mountOpt"} {
+		if mountOptStr := parameters[key]; mountOptStr != "" {
+			if err := json.Unmarshal([]byte(mountOptStr), &mountOpt); err != nil {
+				return vfsOpt, mountOpt, fmt.Errorf("could not parse %s: %w", key, err)
+			}
+		}
+	}
+	return vfsOpt, mountOpt, nil
+}
+
+// multiWriterParameter marks the mount parameters of a volume that is published for writing on several nodes
+const multiWriterParameter = "multiWriter"
+
+// validateMultiWriter rejects options under which writers on different nodes would overwrite each other's
+// changes unnoticed: a full VFS cache serves and keeps stale file content, and the kernel writeback cache
+// delays writes beyond what rclone knows about
+func validateMultiWriter(vfsOpt VfsOpt, mountOpt MountOpt) error {
+	if vfsOpt.CacheMode == "full" {
+		return errors.New("cacheMode full is not supported for volumes with multiple writers")
+	}
+	if mountOpt.WritebackCache {
+		return errors.New("writebackCache is not supported for volumes with multiple writers")
+	}
+	return nil
+}
+
+// parseConfigData returns the remote section of configData, which has to contain exactly one remote
+func parseConfigData(configData string) (*ini.Section, error) {
+	cfg, err := ini.Load([]byte(configData))
 	if err != nil {
-		return fmt.Errorf("mounting failed: couldn't load config %s", err)
+		return nil, fmt.Errorf("couldn't load config %s", err)
 	}
 	secs := cfg.Sections()
 	if len(secs) != 2 { //there's also a DEFAULT section
-		return fmt.Errorf("Mounting failed: expected only one config section: %s", cfg.SectionStrings())
+		return nil, fmt.Errorf("expected only one config section: %s", cfg.SectionStrings())
+	}
+	if secs[1].Key("type").String() == "" {
+		return nil, fmt.Errorf("config section %s has no type", secs[1].Name())
 	}
-	sec := secs[1]
+	return secs[1], nil
+}
+
+func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPath, rcloneConfigData string, readOnly bool, parameters map[string]string) error {
+	configName := rcloneVolume.deploymentName()
+	sec, err := parseConfigData(rcloneConfigData)
+	if err != nil {
+		return fmt.Errorf("mounting failed: %w", err)
+	}
+	r.syncConfigRefs(ctx)
 	params := make(map[string]string)
 	for _, key := range sec.KeyStrings() {
 		if key == "type" {
@@ -139,50 +212,45 @@ func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPa
 		params[key] = sec.Key(key).String()
 	}
 	params["config_refresh_token"] = "false"
-	configOpts := ConfigCreateRequest{
+	klog.Infof("calling config/create for %s", configName)
+	err = r.rc.ConfigCreate(ctx, rc.ConfigCreateRequest{
 		Name:        configName,
 		StorageType: sec.Key("type").String(),
 		Parameters:  params,
 		Opt:         map[string]interface{}{"obscure": true},
-	}
-	postBody, err := json.Marshal(configOpts)
-	if err != nil {
-		return fmt.Errorf("mounting failed: couldn't create request body: %s", err)
-	}
-	klog.Infof("calling config/create with %s", string(postBody))
-	requestBody := bytes.NewBuffer(postBody)
-	resp, err := http.Post(fmt.Sprintf("http://localhost:%d/config/create", r.port), "application/json", requestBody)
+	})
 	if err != nil {
-		return fmt.Errorf("mounting failed: couldn't send HTTP request to create config: %w", err)
-	}
-	if err = checkResponse(resp); err != nil {
 		return fmt.Errorf("mounting failed: couldn't create config: %w", err)
 	}
 	klog.Infof("created config: %s", configName)
 
-	vfsOpt := VfsOpt{
-		CacheMode:    "writes",
-		DirCacheTime: 60 * time.Second,
-		ReadOnly:     readOnly,
-	}
-	if vfsOptStr := parameters["vfsOpt"]; vfsOptStr != "" {
-		if err = json.Unmarshal([]byte(vfsOptStr), &vfsOpt); err != nil {
-			return fmt.Errorf("could not parse vfsOpt: %w", err)
+	if err = r.mount(ctx, rcloneVolume, configName, targetPath, readOnly, parameters); err != nil {
+		// a config that no mount uses would keep the credentials in the daemon
+		if r.configs.count(configName) == 0 {
+			if err := r.rc.ConfigDelete(ctx, configName); err != nil {
+				klog.Errorf("deleting config failed: %v", err)
+			}
 		}
+		return err
 	}
+	r.configs.add(configName, targetPath)
+	klog.Infof("created mount: %s, used by %d mounts", configName, r.configs.count(configName))
+	return nil
+}
 
-	mountOpt := MountOpt{
-		AllowNonEmpty: true,
-		AllowOther:    true,
+func (r *Rclone) mount(ctx context.Context, rcloneVolume *RcloneVolume, configName, targetPath string, readOnly bool, parameters map[string]string) error {
+	vfsOpt, mountOpt, err := mountOptions(parameters, readOnly)
+	if err != nil {
+		return err
 	}
-	if mountOptStr := parameters["mountOpt"]; mountOptStr != "" {
-		if err = json.Unmarshal([]byte(mountOptStr), &mountOpt); err != nil {
-			return fmt.Errorf("could not parse mountOpt: %w", err)
+	if parameters[multiWriterParameter] == "true" {
+		if err = validateMultiWriter(vfsOpt, mountOpt); err != nil {
+			return fmt.Errorf("invalid argument: %w", err)
 		}
 	}
 
 	remoteWithPath := fmt.Sprintf("%s:%s", configName, rcloneVolume.RemotePath)
-	mountArgs := MountRequest{
+	mountArgs := rc.MountRequest{
 		Fs:         remoteWithPath,
 		MountPoint: targetPath,
 		VfsOpt:     vfsOpt,
@@ -193,42 +261,74 @@ func (r *Rclone) Mount(ctx context.Context, rcloneVolume *RcloneVolume, targetPa
 		return err
 	}
 
-	postBody, err = json.Marshal(mountArgs)
-	if err != nil {
-		return fmt.Errorf("mounting failed: couldn't create request body: %s", err)
-	}
-	klog.Infof("calling mount/mount with %s", string(postBody))
-	requestBody = bytes.NewBuffer(postBody)
-	resp, err = http.Post(fmt.Sprintf("http://localhost:%d/mount/mount", r.port), "application/json", requestBody)
-	if err != nil {
-		return fmt.Errorf("mounting failed: couldn't send HTTP request to create mount: %w", err)
-	}
-	if err = checkResponse(resp); err != nil {
+	klog.Infof("calling mount/mount for %s at %s", mountArgs.Fs, mountArgs.MountPoint)
+	if err = r.rc.Mount(ctx, mountArgs); err != nil {
 		return fmt.Errorf("mounting failed: couldn't create mount: %w", err)
 	}
-	klog.Infof("created mount: %s", configName)
 	return nil
 }
 
-func (r *RcloneVolume) deploymentName() string {
-	volumeID := fmt.Sprintf("rclone-mounter-%s", r.ID)
-	if len(volumeID) > 63 {
-		volumeID = volumeID[:63]
+// syncConfigRefs reads the config references from the mounts of the daemon once, they are kept in memory after
+func (r *Rclone) syncConfigRefs(ctx context.Context) {
+	if r.configs.isSynced() {
+		return
 	}
+	mountPoints, err := r.ListMounts(ctx)
+	if err != nil {
+		klog.Warningf("cannot read the config references from the mounts of the rclone daemon: %v", err)
+		return
+	}
+	r.configs.sync(mountPoints)
+}
 
-	return strings.ToLower(volumeID)
+// deploymentName is the name of the rclone config of the volume. The readable part of the volume ID is cut and
+// sanitized, the hash of the full ID keeps the names of distinct volumes apart.
+func (r *RcloneVolume) deploymentName() string {
+	return hashedName("rclone-mounter-"+r.ID, r.ID)
+}
+
+var invalidNameChars = regexp.MustCompile("[^a-z0-9-]+")
+
+// hashedName returns a DNS label made of readable and a hash of key
+func hashedName(readable, key string) string {
+	const maxLength = 63
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:8])
+	name := invalidNameChars.ReplaceAllString(strings.ToLower(readable), "-")
+	if len(name) > maxLength-len(hash)-1 {
+		name = name[:maxLength-len(hash)-1]
+	}
+	return strings.Trim(name, "-") + "-" + hash
 }
 
 func (r *Rclone) CreateVol(ctx context.Context, volumeName, remote, remotePath, rcloneConfigPath string, parameters map[string]string) error {
 	// Create subdirectory under base-dir
-	path := fmt.Sprintf("%s/%s", remotePath, volumeName)
+	path := joinRemotePath(remotePath, volumeName)
 	flags := make(map[string]string)
 	for key, value := range parameters {
 		flags[key] = value
 	}
 	flags["config"] = rcloneConfigPath
 
-	return r.command("mkdir", remote, path, flags)
+	return r.command(ctx, "mkdir", remote, path, flags)
+}
+
+// joinRemotePath appends elem to the remote path without doubling the separator
+func joinRemotePath(remotePath, elem string) string {
+	if remotePath == "" {
+		return elem
+	}
+	return strings.TrimSuffix(remotePath, "/") + "/" + elem
+}
+
+// withPathSuffix appends the remotePathSuffix of a volume, "/<volume name>", to remotePath where CreateVol
+// created its directory
+func withPathSuffix(remotePath, suffix string) string {
+	elem := strings.TrimPrefix(suffix, "/")
+	if elem == "" {
+		return remotePath
+	}
+	return joinRemotePath(remotePath, elem)
 }
 
 func (r Rclone) DeleteVol(ctx context.Context, rcloneVolume *RcloneVolume, rcloneConfigPath string, parameters map[string]string) error {
@@ -237,48 +337,138 @@ func (r Rclone) DeleteVol(ctx context.Context, rcloneVolume *RcloneVolume, rclon
 		flags[key] = value
 	}
 	flags["config"] = rcloneConfigPath
-	return r.command("purge", rcloneVolume.Remote, rcloneVolume.RemotePath, flags)
+	return r.command(ctx, "purge", rcloneVolume.Remote, rcloneVolume.RemotePath, flags)
 }
 
-func (r Rclone) Unmount(ctx context.Context, volumeId string, targetPath string) error {
-	rcloneVolume := &RcloneVolume{ID: volumeId}
+// MoveVol moves the volume to another path on the same remote, server-side where the backend supports it
+func (r Rclone) MoveVol(ctx context.Context, rcloneVolume *RcloneVolume, remotePath, rcloneConfigPath string) error {
+	flags := map[string]string{
+		"config": rcloneConfigPath,
+	}
+	return r.command(ctx, "moveto", rcloneVolume.Remote, rcloneVolume.RemotePath, flags, fmt.Sprintf("%s:%s", rcloneVolume.Remote, remotePath))
+}
 
-	klog.Infof("unmounting %s", rcloneVolume.deploymentName())
-	unmountArgs := UnmountRequest{
-		MountPoint: targetPath,
+// CopyVol copies the content of the source volume into the target volume. Within the same remote the copy is
+// server-side where the backend supports it, otherwise the data is streamed through rclone.
+// Paths matching one of the excludes filter rules are skipped.
+func (r Rclone) CopyVol(ctx context.Context, source, target *RcloneVolume, rcloneConfigPath string, excludes ...string) error {
+	flags := map[string]string{
+		"config": rcloneConfigPath,
 	}
-	postBody, err := json.Marshal(unmountArgs)
-	if err != nil {
-		return fmt.Errorf("unmounting failed: couldn't create request body: %s", err)
+	args := []string{fmt.Sprintf("%s:%s", target.Remote, target.RemotePath)}
+	for _, exclude := range excludes {
+		args = append(args, fmt.Sprintf("--exclude=%s", exclude))
 	}
-	klog.Infof("calling mount/unmount with %s", string(postBody))
-	requestBody := bytes.NewBuffer(postBody)
-	resp, err := http.Post(fmt.Sprintf("http://localhost:%d/mount/unmount", r.port), "application/json", requestBody)
-	if err != nil {
-		return fmt.Errorf("unmounting failed: couldn't send HTTP request: %w", err)
+	return r.command(ctx, "copy", source.Remote, source.RemotePath, flags, args...)
+}
+
+type sizeResponse struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Size returns the total size of the files in the volume
+func (r Rclone) Size(ctx context.Context, rcloneVolume *RcloneVolume, rcloneConfigPath string) (int64, error) {
+	flags := map[string]string{
+		"config": rcloneConfigPath,
+		"json":   "true",
 	}
-	err = checkResponse(resp)
+	out, err := r.commandOutput(ctx, "size", rcloneVolume.Remote, rcloneVolume.RemotePath, flags)
 	if err != nil {
-		return fmt.Errorf("unmounting failed: %w", err)
+		return 0, err
 	}
-	klog.Infof("deleted mount with volume ID %s at path %s", volumeId, targetPath)
+	var size sizeResponse
+	if err := json.Unmarshal(out, &size); err != nil {
+		return 0, fmt.Errorf("cannot parse size of %s:%s: %w", rcloneVolume.Remote, rcloneVolume.RemotePath, err)
+	}
+	return size.Bytes, nil
+}
+
+// AboutResponse is the quota of a remote, fields the backend does not report are nil
+type AboutResponse struct {
+	Total *int64 `json:"total,omitempty"`
+	Used  *int64 `json:"used,omitempty"`
+	Free  *int64 `json:"free,omitempty"`
+}
 
-	configDelete := ConfigDeleteRequest{
-		Name: rcloneVolume.deploymentName(),
+// About returns the quota of the remote, see https://rclone.org/commands/rclone_about/
+func (r Rclone) About(ctx context.Context, remote, remotePath, rcloneConfigPath string) (*AboutResponse, error) {
+	flags := map[string]string{
+		"config": rcloneConfigPath,
+		"json":   "true",
 	}
-	postBody, err = json.Marshal(configDelete)
+	out, err := r.commandOutput(ctx, "about", remote, remotePath, flags)
 	if err != nil {
-		return fmt.Errorf("deleting config failed: couldn't create request body: %s", err)
+		return nil, err
+	}
+	var about AboutResponse
+	if err := json.Unmarshal(out, &about); err != nil {
+		return nil, fmt.Errorf("cannot parse about of %s:%s: %w", remote, remotePath, err)
+	}
+	return &about, nil
+}
+
+// Probe checks that the volume can be listed on the remote with the given config
+func (r Rclone) Probe(ctx context.Context, rcloneVolume *RcloneVolume, rcloneConfigPath string) error {
+	flags := map[string]string{
+		"config":    rcloneConfigPath,
+		"max-depth": "1",
+	}
+	_, err := r.commandOutput(ctx, "lsf", rcloneVolume.Remote, rcloneVolume.RemotePath, flags)
+	return err
+}
+
+// isAboutUnsupported reports whether a failed about command failed because the backend has no quota information
+func isAboutUnsupported(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "doesn't support about")
+}
+
+// ListDirs returns the names of the directories directly below remotePath
+func (r Rclone) ListDirs(ctx context.Context, remote, remotePath, rcloneConfigPath string) ([]string, error) {
+	flags := map[string]string{
+		"config":    rcloneConfigPath,
+		"dirs-only": "true",
 	}
-	klog.Infof("calling config/delete with %s", string(postBody))
-	requestBody = bytes.NewBuffer(postBody)
-	resp, err = http.Post(fmt.Sprintf("http://localhost:%d/config/delete", r.port), "application/json", requestBody)
+	out, err := r.commandOutput(ctx, "lsf", remote, remotePath, flags)
 	if err != nil {
-		klog.Errorf("deleting config failed: couldn't send HTTP request: %v", err)
+		return nil, err
+	}
+	dirs := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if dir := strings.TrimSuffix(strings.TrimSpace(line), "/"); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// isDirNotFound reports whether a failed rclone command failed because the directory does not exist
+func isDirNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "directory not found")
+}
+
+func (r Rclone) Unmount(ctx context.Context, volumeId string, targetPath string) error {
+	rcloneVolume := &RcloneVolume{ID: volumeId}
+	r.syncConfigRefs(ctx)
+	// mounts of earlier versions use configs named differently
+	configName, ok := r.configs.nameOf(targetPath)
+	if !ok {
+		configName = rcloneVolume.deploymentName()
+	}
+
+	klog.Infof("unmounting %s", configName)
+	klog.Infof("calling mount/unmount for %s", targetPath)
+	if err := r.rc.Unmount(ctx, targetPath); err != nil {
+		return fmt.Errorf("unmounting failed: %w", err)
+	}
+	klog.Infof("deleted mount with volume ID %s at path %s", volumeId, targetPath)
+
+	if !r.configs.remove(configName, targetPath) {
+		klog.Infof("keeping config for volume ID %s, still used by %d mounts", volumeId, r.configs.count(configName))
 		return nil
 	}
-	err = checkResponse(resp)
-	if err != nil {
+	klog.Infof("calling config/delete for %s", configName)
+	if err := r.rc.ConfigDelete(ctx, configName); err != nil {
 		klog.Errorf("deleting config failed: %v", err)
 		return nil
 	}
@@ -287,130 +477,119 @@ func (r Rclone) Unmount(ctx context.Context, volumeId string, targetPath string)
 	return nil
 }
 
-func (r Rclone) GetVolumeById(ctx context.Context, volumeId string) (*RcloneVolume, error) {
-	pvs, err := r.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+// ListMounts returns the mounts of the rclone daemon
+func (r Rclone) ListMounts(ctx context.Context) ([]MountPoint, error) {
+	mountPoints, err := r.rc.ListMounts(ctx)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("listing mounts failed: %w", err)
 	}
+	return mountPoints, nil
+}
 
-	for _, pv := range pvs.Items {
-		if pv.Spec.CSI == nil {
-			continue
-		}
-		if pv.Spec.CSI.VolumeHandle == volumeId {
-			var remote string
-			var path string
-			secretRef := pv.Spec.CSI.NodePublishSecretRef
-			secrets := make(map[string]string)
-			if secretRef != nil {
-				sec, err := r.kubeClient.CoreV1().Secrets(secretRef.Namespace).Get(ctx, secretRef.Name, metav1.GetOptions{})
-				if err == nil && sec != nil && len(sec.Data) > 0 {
-					secrets := make(map[string]string)
-					for k, v := range sec.Data {
-						// Note you have to decode the secret here
-						secrets[k] = string(v)
-					}
-				}
-			}
+// VfsStats returns the statistics of the VFS of the mounted fs, see https://rclone.org/rc/#vfs-stats
+func (r Rclone) VfsStats(ctx context.Context, fs string) (*VfsStatsResponse, error) {
+	stats, err := r.rc.VfsStats(ctx, fs)
+	if err != nil {
+		return nil, fmt.Errorf("getting vfs stats failed: %w", err)
+	}
+	return stats, nil
+}
 
-			// This is for compatibility reasons, in the old version the PVC secret was the same name as the PVC
-			// Now the secret is taken from the PVC annotation and injected in the `secrets` map above
-			pvcSecret, err := getSecret(ctx, pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
-			if err != nil && !apierrors.IsNotFound(err) {
-				return nil, err
-			}
+func (r Rclone) GetVolumeById(ctx context.Context, volumeId string) (*RcloneVolume, error) {
+	pv, err := findPV(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
 
-			remote, path, _, _, err = extractFlags(pv.Spec.CSI.VolumeAttributes, secrets, pvcSecret)
-			if err != nil {
-				return nil, err
+	secrets := make(map[string]string)
+	if secretRef := pv.Spec.CSI.NodePublishSecretRef; secretRef != nil {
+		sec, err := r.kubeClient.CoreV1().Secrets(secretRef.Namespace).Get(ctx, secretRef.Name, metav1.GetOptions{})
+		if err == nil && sec != nil {
+			for k, v := range sec.Data {
+				// Note you have to decode the secret here
+				secrets[k] = string(v)
 			}
+		}
+	}
 
-			return &RcloneVolume{
-				Remote:     remote,
-				RemotePath: path,
-				ID:         volumeId,
-			}, nil
+	// This is for compatibility reasons, in the old version the PVC secret was the same name as the PVC
+	// Now the secret is taken from the PVC annotation and injected in the `secrets` map above
+	var pvcSecret *v1.Secret
+	if claimRef := pv.Spec.ClaimRef; claimRef != nil {
+		pvcSecret, err = getSecret(ctx, claimRef.Namespace, claimRef.Name)
+		if apierrors.IsNotFound(err) {
+			pvcSecret = nil
+		} else if err != nil {
+			return nil, err
 		}
 	}
-	return nil, ErrVolumeNotFound
-}
 
-func NewRclone(kubeClient *kubernetes.Clientset, port int) Operations {
-	rclone := &Rclone{
-		execute:    exec.New(),
-		kubeClient: kubeClient,
-		port:       port,
-	}
-	return rclone
-}
-
-// Format from https://rclone.org/rc/#error-returns
-type serverErrorResponse struct {
-	Error  string          `json:"error"`
-	Path   string          `json:"path"`
-	input  json.RawMessage // can contain sensitive info in plain text
-	status int             // same as the http status code
-}
-
-func (s serverErrorResponse) String() string {
-	return fmt.Sprintf(
-		"{%q: %q, %q: %q, %q: %q, %q: %d}",
-		"error",
-		s.Error,
-		"path",
-		s.Path,
-		"input",
-		"<redacted>",
-		"status",
-		s.status,
-	)
+	remote, path, _, _, err := extractFlags(pv.Spec.CSI.VolumeAttributes, secrets, pvcSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RcloneVolume{
+		Remote:     remote,
+		RemotePath: path,
+		ID:         volumeId,
+	}, nil
 }
 
-func checkResponse(resp *http.Response) error {
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		// everything is ok with the response, there should be no error
-		return nil
-	}
-	body, err := io.ReadAll(resp.Body)
-	defer resp.Body.Close()
+func NewRclone(kubeClient kubernetes.Interface) (Operations, error) {
+	id, err := randomHex(8)
 	if err != nil {
-		// NOTE: do not wrap the error in case it contains sensitive information from the body
-		return fmt.Errorf("could not read the error response body from the rclone server")
+		return nil, err
 	}
-	var result serverErrorResponse
-	err = json.Unmarshal(body, &result)
+	pass, err := randomHex(32)
 	if err != nil {
-		// NOTE: do not wrap the error in case it contains sensitive information from the body
-		return fmt.Errorf("could not unmarshal the error response from the rclone server")
+		return nil, err
 	}
-	if result.Error == "" {
-		return fmt.Errorf("unmarshalled the response from the server but it had nothing in the error field")
+	socketPath := filepath.Join(os.TempDir(), fmt.Sprintf("csi-rclone-%s", id), "rc.sock")
+	rclone := &Rclone{
+		execute:    exec.New(),
+		kubeClient: kubeClient,
+		daemon:     &daemonProcess{},
+		configs:    newConfigRefs(),
+		socketPath: socketPath,
+		rcPass:     pass,
+		rc:         rc.NewUnixClient(socketPath, rcUser, pass),
 	}
-	return fmt.Errorf("received error from the rclone server: %s", result.String())
+	return rclone, nil
 }
 
-func (r *Rclone) start_daemon() error {
-	f, err := os.CreateTemp("", "rclone.conf")
-	if err != nil {
-		return err
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("cannot generate random value: %w", err)
 	}
-	rclone_cmd := "rclone"
-	rclone_args := []string{}
-	rclone_args = append(rclone_args, "rcd")
-	rclone_args = append(rclone_args, fmt.Sprintf("--rc-addr=:%d", r.port))
-	rclone_args = append(rclone_args, "--cache-info-age=72h")
-	rclone_args = append(rclone_args, "--cache-chunk-clean-interval=15m")
-	rclone_args = append(rclone_args, "--rc-no-auth")
-	loglevel := os.Getenv("LOG_LEVEL")
-	if len(loglevel) == 0 {
-		loglevel = "NOTICE"
-	}
-	rclone_args = append(rclone_args, fmt.Sprintf("--log-level=%s", loglevel))
-	rclone_args = append(rclone_args, fmt.Sprintf("--config=%s", f.Name()))
-	klog.Infof("running rclone remote control daemon cmd=%s, args=%s, ", rclone_cmd, rclone_args)
+	return hex.EncodeToString(b), nil
+}
 
-	env := os.Environ()
-	cmd := os_exec.Command(rclone_cmd, rclone_args...)
+func (r *Rclone) start_daemon() (*os_exec.Cmd, error) {
+	r.daemon.mutex.Lock()
+	defer r.daemon.mutex.Unlock()
+	if r.daemon.stopped {
+		return nil, errors.New("rclone daemon is stopped")
+	}
+	// a new daemon starts without configs
+	r.configs.reset()
+	// only root may enter the directory of the socket, the socket of a previous daemon is replaced
+	if err := os.MkdirAll(filepath.Dir(r.socketPath), 0700); err != nil {
+		return nil, err
+	}
+	for _, path := range []string{r.socketPath, r.listenPath()} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	// the configs are created through the rc API, a restarted daemon starts with an empty config file
+	configPath := filepath.Join(filepath.Dir(r.socketPath), "rclone.conf")
+	if err := os.WriteFile(configPath, nil, 0600); err != nil {
+		return nil, err
+	}
+	cmd := r.daemonCommand(configPath)
+	klog.Infof("running rclone remote control daemon cmd=%s, args=%s, ", cmd.Path, cmd.Args[1:])
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	stdout, err := cmd.StdoutPipe()
 	cmd.Stderr = cmd.Stdout
@@ -418,9 +597,8 @@ func (r *Rclone) start_daemon() error {
 		panic("couldn't get stderr of rclone process")
 	}
 	scanner := bufio.NewScanner(stdout)
-	cmd.Env = env
 	if err := cmd.Start(); err != nil {
-		return err
+		return nil, err
 	}
 	go func() {
 		output := ""
@@ -429,34 +607,111 @@ func (r *Rclone) start_daemon() error {
 			klog.Infof("rclone log: %s", output)
 		}
 	}()
-	r.daemonCmd = cmd
+	r.daemon.cmd = cmd
+	return cmd, nil
+}
+
+// rcUser is the user of the rc API, its password is generated on every start of the plugin
+const rcUser = "csi-rclone"
+
+// daemonCommand is the command of the rclone daemon. the credentials of the rc API are passed in the environment
+// to keep them out of the process list.
+func (r *Rclone) daemonCommand(configPath string) *os_exec.Cmd {
+	rclone_cmd := "rclone"
+	rclone_args := []string{}
+	rclone_args = append(rclone_args, "rcd")
+	rclone_args = append(rclone_args, fmt.Sprintf("--rc-addr=unix://%s", r.listenPath()))
+	rclone_args = append(rclone_args, "--cache-info-age=72h")
+	rclone_args = append(rclone_args, "--cache-chunk-clean-interval=15m")
+	loglevel := os.Getenv("LOG_LEVEL")
+	if len(loglevel) == 0 {
+		loglevel = "NOTICE"
+	}
+	rclone_args = append(rclone_args, fmt.Sprintf("--log-level=%s", loglevel))
+	rclone_args = append(rclone_args, fmt.Sprintf("--config=%s", configPath))
+
+	cmd := os_exec.Command(rclone_cmd, rclone_args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("RCLONE_RC_USER=%s", rcUser), fmt.Sprintf("RCLONE_RC_PASS=%s", r.rcPass))
+	return cmd
+}
+
+// listenPath is where the daemon creates its socket. the rc client connects to socketPath, which the socket is
+// only moved to once it is restricted to the node plugin.
+func (r *Rclone) listenPath() string {
+	return r.socketPath + ".new"
+}
+
+// publishSocket waits for the daemon to create its socket, makes it accessible to the owner only and moves it to
+// socketPath, where the rc client connects to it. exited receives the result of the daemon if it exits.
+func (r *Rclone) publishSocket(exited <-chan error) error {
+	deadline := time.After(daemonStartTimeout)
+	for {
+		err := os.Chmod(r.listenPath(), 0600)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("cannot restrict permissions of the rc socket: %w", err)
+		}
+		select {
+		case err := <-exited:
+			return fmt.Errorf("rclone daemon exited before creating its rc socket: %v", err)
+		case <-deadline:
+			return fmt.Errorf("rclone daemon did not create its rc socket within %s", daemonStartTimeout)
+		case <-time.After(daemonPollInterval):
+		}
+	}
+	if err := os.Rename(r.listenPath(), r.socketPath); err != nil {
+		return fmt.Errorf("cannot move the rc socket: %w", err)
+	}
 	return nil
 }
 
 func (r *Rclone) Run() error {
-	err := r.start_daemon()
+	cmd, err := r.start_daemon()
 	if err != nil {
 		return err
 	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	if err := r.publishSocket(exited); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
 	// blocks until the rclone daemon is stopped
-	return r.daemonCmd.Wait()
+	return <-exited
 }
 
+// Cleanup kills the rclone daemon and removes its socket and config, the daemon is not started again
 func (r *Rclone) Cleanup() error {
 	klog.Info("cleaning up background process")
-	if r.daemonCmd == nil {
-		return nil
-	}
-	return r.daemonCmd.Process.Kill()
+	r.daemon.mutex.Lock()
+	defer r.daemon.mutex.Unlock()
+	r.daemon.stopped = true
+	var err error
+	if r.daemon.cmd != nil {
+		err = r.daemon.cmd.Process.Kill()
+	}
+	os.RemoveAll(filepath.Dir(r.socketPath))
+	return err
 }
 
-func (r *Rclone) command(cmd, remote, remotePath string, flags map[string]string) error {
-	// rclone <operand> remote:path [flag]
+func (r *Rclone) command(ctx context.Context, cmd, remote, remotePath string, flags map[string]string, extraArgs ...string) error {
+	_, err := r.commandOutput(ctx, cmd, remote, remotePath, flags, extraArgs...)
+	return err
+}
+
+// commandOutput runs the rclone command, it is killed when ctx is done
+func (r *Rclone) commandOutput(ctx context.Context, cmd, remote, remotePath string, flags map[string]string, extraArgs ...string) ([]byte, error) {
+	// rclone <operand> remote:path [extra args] [flag]
 	args := append(
 		[]string{},
 		cmd,
 		fmt.Sprintf("%s:%s", remote, remotePath),
 	)
+	args = append(args, extraArgs...)
 
 	// Add user supplied flags
 	for k, v := range flags {
@@ -464,11 +719,15 @@ func (r *Rclone) command(cmd, remote, remotePath string, flags map[string]string
 	}
 
 	klog.Infof("executing %s command cmd=rclone, remote=%s:%s", cmd, remote, remotePath)
-	out, err := r.execute.Command("rclone", args...).CombinedOutput()
+	// stdout is returned to the caller, e.g. for parsing JSON, so the log output on stderr is kept separate
+	stderr := &bytes.Buffer{}
+	command := r.execute.CommandContext(ctx, "rclone", args...)
+	command.SetStderr(stderr)
+	out, err := command.Output()
 	if err != nil {
-		return fmt.Errorf("%s failed: %v cmd: 'rclone' remote: '%s' remotePath:'%s' args:'%s'  output: %q",
-			cmd, err, remote, remotePath, args, string(out))
+		return nil, fmt.Errorf("%s failed: %v cmd: 'rclone' remote: '%s' remotePath:'%s' args:'%s'  output: %q",
+			cmd, err, remote, remotePath, args, string(out)+stderr.String())
 	}
 
-	return nil
+	return out, nil
 }
@@ -0,0 +1,221 @@
+package rclone
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestValidateMountOption(t *testing.T) {
+	tests := []struct {
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{key: "vfsOpt", value: `{"cacheMode":"full","dirCacheTime":60000000000}`},
+		{key: "vfsOpt", value: `{"cacheMode":"everything"}`, wantErr: true},
+		{key: "vfsOpt", value: `{"cacheMode":`, wantErr: true},
+		{key: "mountOpt", value: `{"allowOther":true,"extraFlags":["--fast-list"]}`},
+		{key: "mountOpt", value: `{"allowOther":"yes"}`, wantErr: true},
+		{key: "mountOpt", value: `{"unknown":true}`, wantErr: true},
+		{key: "cacheOpt", value: `{}`, wantErr: true},
+	}
+	for _, test := range tests {
+		err := validateMountOption(test.key, test.value)
+		if test.wantErr && err == nil {
+			t.Errorf("validateMountOption(%s, %s) did not fail", test.key, test.value)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("validateMountOption(%s, %s) failed: %v", test.key, test.value, err)
+		}
+	}
+}
+
+func TestParseConfigData(t *testing.T) {
+	section, err := parseConfigData("[s3]\ntype = s3\nprovider = AWS\n")
+	if err != nil {
+		t.Fatalf("parseConfigData failed: %v", err)
+	}
+	if section.Name() != "s3" || section.Key("provider").String() != "AWS" {
+		t.Errorf("parseConfigData returned section %s with provider %q", section.Name(), section.Key("provider").String())
+	}
+
+	for name, configData := range map[string]string{
+		"no section":       "type = s3\n",
+		"two sections":     "[a]\ntype = s3\n[b]\ntype = s3\n",
+		"section w/o type": "[s3]\nprovider = AWS\n",
+	} {
+		if _, err := parseConfigData(configData); err == nil {
+			t.Errorf("parseConfigData with %s did not fail", name)
+		}
+	}
+}
+
+func TestMountOptions(t *testing.T) {
+	parameters := map[string]string{
+		"vfsOpt":          `{"cacheMode":"full","dirCacheTime":1000000000}`,
+		"modified.vfsOpt": `{"cacheMode":"minimal"}`,
+		"mountOpt":        `{"allowOther":false}`,
+		"capacityBytes":   "1024",
+	}
+	vfsOpt, mountOpt, err := mountOptions(parameters, true)
+	if err != nil {
+		t.Fatalf("mountOptions failed: %v", err)
+	}
+	if vfsOpt.CacheMode != "minimal" {
+		t.Errorf("modified cacheMode was not applied, got %q", vfsOpt.CacheMode)
+	}
+	if vfsOpt.DirCacheTime != time.Second {
+		t.Errorf("dirCacheTime of the StorageClass was not kept, got %v", vfsOpt.DirCacheTime)
+	}
+	if !vfsOpt.ReadOnly {
+		t.Error("read-only publication is not read-only")
+	}
+	if vfsOpt.DiskSpaceTotalSize != 1024 {
+		t.Errorf("capacity is not reported as the disk size, got %d", vfsOpt.DiskSpaceTotalSize)
+	}
+	if mountOpt.AllowOther || !mountOpt.AllowNonEmpty {
+		t.Errorf("mountOpt does not merge with the defaults, got %+v", mountOpt)
+	}
+
+	vfsOpt, _, err = mountOptions(map[string]string{"vfsOpt": `{"readOnly":false,"diskSpaceTotalSize":10}`, "capacityBytes": "1024"}, true)
+	if err != nil {
+		t.Fatalf("mountOptions failed: %v", err)
+	}
+	if !vfsOpt.ReadOnly || vfsOpt.DiskSpaceTotalSize != 10 {
+		t.Errorf("got readOnly %v and disk size %d, want true and 10", vfsOpt.ReadOnly, vfsOpt.DiskSpaceTotalSize)
+	}
+
+	if _, _, err := mountOptions(map[string]string{"mountOpt": "{"}, false); err == nil {
+		t.Error("invalid mountOpt was accepted")
+	}
+}
+
+func TestHashedName(t *testing.T) {
+	long := "rclone-mounter-" + strings.Repeat("Pvc_0123456789", 10)
+	name := hashedName(long, "node-a/pvc-1")
+	if len(name) > 63 {
+		t.Errorf("hashedName is %d characters long: %s", len(name), name)
+	}
+	if name != strings.ToLower(name) || strings.ContainsAny(name, "_.") {
+		t.Errorf("hashedName is not a valid name: %s", name)
+	}
+	if hashedName(long, "node-a/pvc-1") != name {
+		t.Error("hashedName is not deterministic")
+	}
+	if hashedName(long, "node-b/pvc-1") == name {
+		t.Error("hashedName does not differ by key")
+	}
+	if short := hashedName("rclone-mounter-pvc-1", "node-a/pvc-1"); !strings.HasPrefix(short, "rclone-mounter-pvc-1-") {
+		t.Errorf("hashedName does not keep the readable part: %s", short)
+	}
+}
+
+func TestDaemonCredentials(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	ops, err := NewRclone(nil)
+	if err != nil {
+		t.Fatalf("NewRclone failed: %v", err)
+	}
+	r := ops.(*Rclone)
+	if len(r.rcPass) != 64 {
+		t.Fatalf("rc password %q was not generated", r.rcPass)
+	}
+
+	cmd := r.daemonCommand("/tmp/rclone.conf")
+	args := strings.Join(cmd.Args, " ")
+	if !strings.Contains(args, "rcd --rc-addr=unix://"+r.listenPath()) {
+		t.Errorf("daemon does not listen on the socket: %s", args)
+	}
+	if strings.Contains(args, r.rcPass) {
+		t.Errorf("rc password is in the arguments of the daemon: %s", args)
+	}
+	env := strings.Join(cmd.Env, "\n")
+	if !strings.Contains(env, "RCLONE_RC_USER="+rcUser+"\n") || !strings.HasSuffix(env, "RCLONE_RC_PASS="+r.rcPass) {
+		t.Errorf("rc credentials are not passed in the environment of the daemon")
+	}
+
+	// a daemon which, like rclone, refuses calls without its credentials
+	if err := os.MkdirAll(filepath.Dir(r.socketPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", r.listenPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, ok := req.BasicAuth(); !ok || user != rcUser || pass != r.rcPass {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"authentication required","status":401}`))
+			return
+		}
+		w.Write([]byte(`{"mountPoints":[]}`))
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	if err := r.publishSocket(make(chan error)); err != nil {
+		t.Fatalf("publishSocket failed: %v", err)
+	}
+	info, err := os.Stat(r.socketPath)
+	if err != nil {
+		t.Fatalf("socket was not moved to %s: %v", r.socketPath, err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("socket has permissions %v, want 0600", info.Mode().Perm())
+	}
+	if _, err := r.ListMounts(context.Background()); err != nil {
+		t.Errorf("rc client does not send the credentials of the daemon: %v", err)
+	}
+}
+
+func TestPublishSocketDaemonExited(t *testing.T) {
+	r := &Rclone{socketPath: filepath.Join(t.TempDir(), "rc.sock")}
+	exited := make(chan error, 1)
+	exited <- nil
+	if err := r.publishSocket(exited); err == nil {
+		t.Error("publishSocket did not fail for a daemon that exited")
+	}
+}
+
+func TestRemotePathOfVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		remotePath string
+		want       string
+	}{
+		{name: "empty remotePath", remotePath: "", want: "pvc-x"},
+		{name: "trailing slash", remotePath: "bucket/", want: "bucket/pvc-x"},
+		{name: "plain", remotePath: "bucket/volumes", want: "bucket/volumes/pvc-x"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the directory CreateVol creates has to be the one the volume is published, reclaimed and mounted at
+			if got := joinRemotePath(test.remotePath, "pvc-x"); got != test.want {
+				t.Errorf("joinRemotePath = %q, want %q", got, test.want)
+			}
+			if got := withPathSuffix(test.remotePath, "/pvc-x"); got != test.want {
+				t.Errorf("withPathSuffix = %q, want %q", got, test.want)
+			}
+			volumeContext := map[string]string{"remote": "s3", "remotePath": test.remotePath, "remotePathSuffix": "/pvc-x"}
+			_, remotePath, _, _, err := extractFlags(volumeContext, nil, nil)
+			if err != nil {
+				t.Fatalf("extractFlags failed: %v", err)
+			}
+			if remotePath != test.want {
+				t.Errorf("remotePath of the mount = %q, want %q", remotePath, test.want)
+			}
+		})
+	}
+	if got := withPathSuffix("bucket", ""); got != "bucket" {
+		t.Errorf("withPathSuffix without suffix = %q, want bucket", got)
+	}
+}
@@ -0,0 +1,209 @@
+package rclone
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// daemonStartTimeout is how long the recovery waits for the rc API of a freshly started rclone daemon
+	daemonStartTimeout = 30 * time.Second
+	daemonPollInterval = 500 * time.Millisecond
+
+	// the backoff between restarts of the rclone daemon doubles up to daemonMaxBackoff and is reset once the
+	// daemon ran for daemonStableTime
+	daemonMinBackoff = time.Second
+	daemonMaxBackoff = time.Minute
+	daemonStableTime = 10 * time.Minute
+)
+
+var daemonRestarts = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "csi_rclone_daemon_restarts_total",
+	Help: "Restarts of the rclone daemon after it exited.",
+})
+
+// runDaemon runs the rclone daemon and restarts it when it exits, until the node server is stopped. The mounts of
+// the mount state are re-created after every start.
+func (ns *nodeServer) runDaemon() error {
+	backoff := daemonMinBackoff
+	restarts := 0
+	for {
+		go ns.recoverMounts(context.Background())
+		started := time.Now()
+		err := ns.RcloneOps.Run()
+		if ns.stopped() {
+			return err
+		}
+		if time.Since(started) > daemonStableTime {
+			backoff = daemonMinBackoff
+		}
+		restarts++
+		daemonRestarts.Inc()
+		klog.Errorf("rclone daemon exited after %s: %v, restarting it in %s (restart %d)", time.Since(started).Round(time.Second), err, backoff, restarts)
+		select {
+		case <-ns.stop:
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > daemonMaxBackoff {
+			backoff = daemonMaxBackoff
+		}
+	}
+}
+
+// recoverMounts re-creates the mounts of the mount state once the rclone daemon is up. The mounts of the previous
+// daemon died with it, so the staging paths are mounted again and bound to the target paths of the pods that
+// still use them. Mounts of mounter pods survive restarts of the node plugin and are only re-created if they are
+// gone.
+func (ns *nodeServer) recoverMounts(ctx context.Context) {
+	ns.mutex.Lock()
+	volumes := ns.state.list()
+	ns.mutex.Unlock()
+	if len(volumes) == 0 {
+		return
+	}
+	// staging and publishing go on while the daemon starts
+	if ns.mounterPods == nil {
+		if err := ns.waitForDaemon(ctx); err != nil {
+			klog.Errorf("cannot recover mounts: %v", err)
+			return
+		}
+	}
+
+	klog.Infof("recovering mounts of %d volumes", len(volumes))
+	for _, volume := range volumes {
+		ns.recoverVolume(ctx, volume.VolumeId)
+	}
+}
+
+// recoverVolume re-creates the mounts of a volume of the mount state unless its mount is alive
+func (ns *nodeServer) recoverVolume(ctx context.Context, volumeId string) {
+	defer ns.volumeLocks.lock(volumeId)()
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	// volumes unstaged or staged while waiting for the daemon and mounts of mounter pods, which survive the restart
+	// unless the pod is gone or its rclone died, are skipped
+	volume, ok := ns.state.getVolume(volumeId)
+	if !ok || ns.isLiveMount(ctx, volume.StagingPath) {
+		return
+	}
+	rcloneVol, configData, parameters, err := resolveStagedVolume(ctx, volume)
+	if err != nil {
+		klog.Errorf("cannot recover mount of volume %s at %s: %v", volume.VolumeId, volume.StagingPath, err)
+		return
+	}
+	// the bind mounts of a dead mount have to be replaced as well
+	for _, targetPath := range volume.targetPaths() {
+		ns.unmountStale(volume.VolumeId, targetPath)
+	}
+	ns.unmountStale(volume.VolumeId, volume.StagingPath)
+	if ns.mounterPods != nil {
+		err = ns.mounterPods.Start(ctx, rcloneVol, volume.StagingPath, configData, volume.ReadOnly, parameters)
+		if err == nil {
+			err = ns.unlocked(func() error { return ns.mounterPods.WaitMounted(ctx, volume.VolumeId, volume.StagingPath) })
+		}
+	} else {
+		err = ns.RcloneOps.Mount(ctx, rcloneVol, volume.StagingPath, configData, volume.ReadOnly, parameters)
+	}
+	if err != nil {
+		klog.Errorf("cannot recover mount of volume %s at %s: %v", volume.VolumeId, volume.StagingPath, err)
+		return
+	}
+	// volumes staged by earlier versions are recovered with the current config name
+	if volume.ConfigName != rcloneVol.deploymentName() {
+		volume.ConfigName = rcloneVol.deploymentName()
+		if err := ns.state.putVolume(volume); err != nil {
+			klog.Warningf("cannot update config name of volume %s in the mount state: %v", volume.VolumeId, err)
+		}
+	}
+	for _, targetPath := range volume.targetPaths() {
+		options := []string{"bind"}
+		if volume.TargetPaths[targetPath] {
+			options = append(options, "ro")
+		}
+		if err := ns.mounter.Mount(volume.StagingPath, targetPath, "", options); err != nil {
+			klog.Errorf("cannot recover mount of volume %s at %s: %v", volume.VolumeId, targetPath, err)
+			continue
+		}
+	}
+	klog.Infof("recovered mounts of volume %s", volume.VolumeId)
+}
+
+// resolveStagedVolume resolves the remote config and mount parameters of a staged volume like NodeStageVolume. The
+// mount state doesn't contain credentials, so the node stage and node publish secrets are read from the PV.
+func resolveStagedVolume(ctx context.Context, volume stagedVolume) (*RcloneVolume, string, map[string]string, error) {
+	pv, err := findPV(ctx, volume.VolumeId)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("cannot read PV: %w", err)
+	}
+	secrets := map[string]string{}
+	for _, secretRef := range []*v1.SecretReference{pv.Spec.CSI.NodeStageSecretRef, pv.Spec.CSI.NodePublishSecretRef} {
+		if secretRef == nil {
+			continue
+		}
+		secret, err := getSecret(ctx, secretRef.Namespace, secretRef.Name)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("cannot read secret %s/%s: %w", secretRef.Namespace, secretRef.Name, err)
+		}
+		for key, value := range secret.Data {
+			secrets[key] = string(value)
+		}
+	}
+
+	remote, remotePath, configData, parameters, err := resolveMount(ctx, pv.Spec.CSI.VolumeAttributes, secrets)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if remote == "" || configData == "" {
+		return nil, "", nil, fmt.Errorf("no remote configuration found in the secrets of PV %s", pv.Name)
+	}
+	applyVolumeUpdates(ctx, volume.VolumeId, parameters)
+	if volume.MultiWriter {
+		parameters[multiWriterParameter] = "true"
+	}
+	return &RcloneVolume{ID: volume.VolumeId, Remote: remote, RemotePath: remotePath}, configData, parameters, nil
+}
+
+// unmountStale removes the mount at path if there is one
+func (ns *nodeServer) unmountStale(volumeId, path string) {
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(path)
+	if err == nil && notMnt || os.IsNotExist(err) {
+		return
+	}
+	if err := ns.mounter.Unmount(path); err != nil {
+		klog.Warningf("cannot remove stale mount of volume %s at %s: %v", volumeId, path, err)
+	}
+}
+
+// stopped reports if the node server is stopped
+func (ns *nodeServer) stopped() bool {
+	select {
+	case <-ns.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitForDaemon waits until the rc API of the rclone daemon answers
+func (ns *nodeServer) waitForDaemon(ctx context.Context) error {
+	deadline := time.Now().Add(daemonStartTimeout)
+	for {
+		_, err := ns.RcloneOps.ListMounts(ctx)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(daemonPollInterval)
+	}
+}
@@ -0,0 +1,260 @@
+// The volume registry remembers the volumes and snapshots created by the controller. It is persisted in a
+// ConfigMap so that restarts and failovers of the controller are invisible to the external-provisioner.
+
+package rclone
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	registryVolumesKey   = "volumes"
+	registrySnapshotsKey = "snapshots"
+
+	// registryMaxBytes limits the records in the ConfigMap, which can't be larger than 1 MiB including its
+	// metadata
+	registryMaxBytes = 1000 * 1024
+)
+
+// errRegistryFull is returned when a record does not fit into the registry ConfigMap anymore
+var errRegistryFull = errors.New("volume registry is full")
+
+type volumeRecord struct {
+	CapacityBytes int64 `json:"capacityBytes"`
+	// Remote, RemotePath and RemotePathSuffix are only set for volumes that own a directory on the remote
+	Remote           string `json:"remote,omitempty"`
+	RemotePath       string `json:"remotePath,omitempty"`
+	RemotePathSuffix string `json:"remotePathSuffix,omitempty"`
+	// SecretName and SecretNamespace reference the PVC secret the volume was created with
+	SecretName      string `json:"secretName,omitempty"`
+	SecretNamespace string `json:"secretNamespace,omitempty"`
+	// ProvisionerSecretName and ProvisionerSecretNamespace reference the provisioner secret of the StorageClass,
+	// for requests without secrets like ControllerGetVolume
+	ProvisionerSecretName      string `json:"provisionerSecretName,omitempty"`
+	ProvisionerSecretNamespace string `json:"provisionerSecretNamespace,omitempty"`
+	ReclaimPolicy              string `json:"reclaimPolicy,omitempty"`
+	ArchiveRetention           string `json:"archiveRetention,omitempty"`
+	// MutableParameters are the parameters of the VolumeAttributesClass, set by CreateVolume and ControllerModifyVolume
+	MutableParameters map[string]string `json:"mutableParameters,omitempty"`
+	// MultiWriter is set for volumes created for writers on several nodes
+	MultiWriter bool `json:"multiWriter,omitempty"`
+	// AccessibleTopology are the topology segments the volume is constrained to
+	AccessibleTopology []map[string]string `json:"accessibleTopology,omitempty"`
+}
+
+type snapshotRecord struct {
+	SourceVolumeID string `json:"sourceVolumeId"`
+	Remote         string `json:"remote"`
+	RemotePath     string `json:"remotePath"`
+	// SecretName and SecretNamespace reference the PVC secret of the source volume
+	SecretName      string `json:"secretName,omitempty"`
+	SecretNamespace string `json:"secretNamespace,omitempty"`
+	SizeBytes       int64  `json:"sizeBytes"`
+	CreationTime    int64  `json:"creationTime"`
+	// Pending is set while the source volume is copied to the snapshot
+	Pending bool `json:"pending,omitempty"`
+}
+
+// registryState is the content of the registry ConfigMap
+type registryState struct {
+	volumes   map[string]volumeRecord
+	snapshots map[string]snapshotRecord
+}
+
+type volumeRegistry struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	name       string
+
+	mutex sync.RWMutex
+	state registryState
+}
+
+func newVolumeRegistry(kubeClient kubernetes.Interface, namespace, name string) *volumeRegistry {
+	return &volumeRegistry{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		name:       name,
+		state: registryState{
+			volumes:   map[string]volumeRecord{},
+			snapshots: map[string]snapshotRecord{},
+		},
+	}
+}
+
+// load reads the persisted volumes into memory, creating the backing ConfigMap if it does not exist yet.
+func (r *volumeRegistry) load(ctx context.Context) error {
+	cm, err := r.kubeClient.CoreV1().ConfigMaps(r.namespace).Get(ctx, r.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm, err = r.kubeClient.CoreV1().ConfigMaps(r.namespace).Create(ctx, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: r.name, Namespace: r.namespace},
+		}, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			cm, err = r.kubeClient.CoreV1().ConfigMaps(r.namespace).Get(ctx, r.name, metav1.GetOptions{})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read volume registry %s/%s: %w", r.namespace, r.name, err)
+	}
+	state, err := decodeState(cm)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.state = state
+	klog.Infof("loaded %d volumes and %d snapshots from registry %s/%s", len(state.volumes), len(state.snapshots), r.namespace, r.name)
+	return nil
+}
+
+// refresh re-reads the persisted volumes. Another controller instance, e.g. the previous leader, may have changed
+// them since they were loaded, so the controller refreshes them before it reads from the registry.
+func (r *volumeRegistry) refresh(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	cm, err := r.kubeClient.CoreV1().ConfigMaps(r.namespace).Get(ctx, r.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot read volume registry %s/%s: %w", r.namespace, r.name, err)
+	}
+	state, err := decodeState(cm)
+	if err != nil {
+		return err
+	}
+	r.state = state
+	return nil
+}
+
+func (r *volumeRegistry) get(volumeId string) (volumeRecord, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	record, ok := r.state.volumes[volumeId]
+	return record, ok
+}
+
+// list returns the IDs of all registered volumes in a stable order.
+func (r *volumeRegistry) list() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return sortedKeys(r.state.volumes)
+}
+
+func (r *volumeRegistry) put(ctx context.Context, volumeId string, record volumeRecord) error {
+	return r.update(ctx, func(state registryState) {
+		state.volumes[volumeId] = record
+	})
+}
+
+func (r *volumeRegistry) remove(ctx context.Context, volumeId string) error {
+	return r.update(ctx, func(state registryState) {
+		delete(state.volumes, volumeId)
+	})
+}
+
+func (r *volumeRegistry) getSnapshot(snapshotId string) (snapshotRecord, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	record, ok := r.state.snapshots[snapshotId]
+	return record, ok
+}
+
+// listSnapshots returns the IDs of all registered snapshots in a stable order.
+func (r *volumeRegistry) listSnapshots() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return sortedKeys(r.state.snapshots)
+}
+
+func (r *volumeRegistry) putSnapshot(ctx context.Context, snapshotId string, record snapshotRecord) error {
+	return r.update(ctx, func(state registryState) {
+		state.snapshots[snapshotId] = record
+	})
+}
+
+func (r *volumeRegistry) removeSnapshot(ctx context.Context, snapshotId string) error {
+	return r.update(ctx, func(state registryState) {
+		delete(state.snapshots, snapshotId)
+	})
+}
+
+// update applies mutate to the latest persisted state and writes it back. The ConfigMap is the source of
+// truth, so a conflicting write from another controller instance is re-read before mutate is applied again.
+// Records that would grow the ConfigMap beyond registryMaxBytes are refused with errRegistryFull, removing
+// records always succeeds.
+func (r *volumeRegistry) update(ctx context.Context, mutate func(registryState)) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := r.kubeClient.CoreV1().ConfigMaps(r.namespace).Get(ctx, r.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		state, err := decodeState(cm)
+		if err != nil {
+			return err
+		}
+		mutate(state)
+		volumes, err := json.Marshal(state.volumes)
+		if err != nil {
+			return err
+		}
+		snapshots, err := json.Marshal(state.snapshots)
+		if err != nil {
+			return err
+		}
+		size := len(volumes) + len(snapshots)
+		if previous := len(cm.Data[registryVolumesKey]) + len(cm.Data[registrySnapshotsKey]); size > registryMaxBytes && size > previous {
+			return fmt.Errorf("%w: registry %s/%s would grow to %d bytes, but a ConfigMap is limited to 1 MiB. delete unused volumes or snapshots",
+				errRegistryFull, r.namespace, r.name, size)
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[registryVolumesKey] = string(volumes)
+		cm.Data[registrySnapshotsKey] = string(snapshots)
+		if _, err = r.kubeClient.CoreV1().ConfigMaps(r.namespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		r.state = state
+		return nil
+	})
+}
+
+func decodeState(cm *v1.ConfigMap) (registryState, error) {
+	state := registryState{
+		volumes:   map[string]volumeRecord{},
+		snapshots: map[string]snapshotRecord{},
+	}
+	if data := cm.Data[registryVolumesKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), &state.volumes); err != nil {
+			return state, fmt.Errorf("cannot decode volumes of registry %s/%s: %w", cm.Namespace, cm.Name, err)
+		}
+	}
+	if data := cm.Data[registrySnapshotsKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), &state.snapshots); err != nil {
+			return state, fmt.Errorf("cannot decode snapshots of registry %s/%s: %w", cm.Namespace, cm.Name, err)
+		}
+	}
+	return state, nil
+}
+
+func sortedKeys[T any](records map[string]T) []string {
+	ids := make([]string, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,132 @@
+package rclone
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDecodeState(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "csi-rclone-volumes", Namespace: "csi-rclone"},
+		Data: map[string]string{
+			registryVolumesKey:   `{"pvc-1":{"capacityBytes":1024,"remote":"s3","remotePath":"bucket","multiWriter":true}}`,
+			registrySnapshotsKey: `{"snap-1":{"sourceVolumeId":"pvc-1","remote":"s3","remotePath":"bucket/snap-1","sizeBytes":10,"creationTime":5}}`,
+		},
+	}
+	state, err := decodeState(cm)
+	if err != nil {
+		t.Fatalf("decodeState failed: %v", err)
+	}
+	wantVolume := volumeRecord{CapacityBytes: 1024, Remote: "s3", RemotePath: "bucket", MultiWriter: true}
+	if got := state.volumes["pvc-1"]; !reflect.DeepEqual(got, wantVolume) {
+		t.Errorf("volume pvc-1 = %+v, want %+v", got, wantVolume)
+	}
+	wantSnapshot := snapshotRecord{SourceVolumeID: "pvc-1", Remote: "s3", RemotePath: "bucket/snap-1", SizeBytes: 10, CreationTime: 5}
+	if got := state.snapshots["snap-1"]; !reflect.DeepEqual(got, wantSnapshot) {
+		t.Errorf("snapshot snap-1 = %+v, want %+v", got, wantSnapshot)
+	}
+}
+
+func TestDecodeStateEmpty(t *testing.T) {
+	state, err := decodeState(&v1.ConfigMap{})
+	if err != nil {
+		t.Fatalf("decodeState failed: %v", err)
+	}
+	if state.volumes == nil || state.snapshots == nil {
+		t.Fatalf("decodeState of an empty ConfigMap must return empty maps, got %+v", state)
+	}
+	if len(state.volumes) != 0 || len(state.snapshots) != 0 {
+		t.Errorf("decodeState of an empty ConfigMap returned records: %+v", state)
+	}
+}
+
+func TestDecodeStateInvalid(t *testing.T) {
+	for _, key := range []string{registryVolumesKey, registrySnapshotsKey} {
+		cm := &v1.ConfigMap{Data: map[string]string{key: "{"}}
+		if _, err := decodeState(cm); err == nil {
+			t.Errorf("decodeState with invalid %s did not fail", key)
+		}
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	got := sortedKeys(map[string]volumeRecord{"pvc-b": {}, "pvc-c": {}, "pvc-a": {}})
+	want := []string{"pvc-a", "pvc-b", "pvc-c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sortedKeys = %v, want %v", got, want)
+	}
+	if got := sortedKeys(map[string]snapshotRecord{}); len(got) != 0 {
+		t.Errorf("sortedKeys of an empty map = %v", got)
+	}
+}
+
+func TestVolumeRegistryPersistence(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	registry := newVolumeRegistry(client, "csi-rclone", "csi-rclone-volumes")
+	if err := registry.load(ctx); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if err := registry.put(ctx, "pvc-1", volumeRecord{CapacityBytes: 1024}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if err := registry.putSnapshot(ctx, "snap-1", snapshotRecord{SourceVolumeID: "pvc-1"}); err != nil {
+		t.Fatalf("putSnapshot failed: %v", err)
+	}
+
+	// another controller instance sees the records
+	other := newVolumeRegistry(client, "csi-rclone", "csi-rclone-volumes")
+	if err := other.load(ctx); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if record, ok := other.get("pvc-1"); !ok || record.CapacityBytes != 1024 {
+		t.Errorf("volume pvc-1 = %+v, %v", record, ok)
+	}
+	if _, ok := other.getSnapshot("snap-1"); !ok {
+		t.Error("snapshot snap-1 was not persisted")
+	}
+
+	if err := other.remove(ctx, "pvc-1"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if err := registry.refresh(ctx); err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	if _, ok := registry.get("pvc-1"); ok {
+		t.Error("refresh did not pick up the removal by another instance")
+	}
+}
+
+func TestVolumeRegistryFull(t *testing.T) {
+	ctx := context.Background()
+	registry := newVolumeRegistry(fake.NewSimpleClientset(), "csi-rclone", "csi-rclone-volumes")
+	if err := registry.load(ctx); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	large := volumeRecord{MutableParameters: map[string]string{"vfsOpt": strings.Repeat("x", registryMaxBytes/2)}}
+	if err := registry.put(ctx, "pvc-1", large); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	err := registry.put(ctx, "pvc-2", large)
+	if !errors.Is(err, errRegistryFull) {
+		t.Fatalf("put beyond the limit returned %v, want %v", err, errRegistryFull)
+	}
+	if _, ok := registry.get("pvc-2"); ok {
+		t.Error("refused volume was registered")
+	}
+	if code := status.Code(registryError(err, "cannot register volume %s", "pvc-2")); code != codes.ResourceExhausted {
+		t.Errorf("full registry is reported as %v, want %v", code, codes.ResourceExhausted)
+	}
+	if err := registry.remove(ctx, "pvc-1"); err != nil {
+		t.Errorf("remove from a full registry failed: %v", err)
+	}
+}
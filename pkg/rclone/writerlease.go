@@ -0,0 +1,145 @@
+// Writer leases make sure that a remote path is published for writing on a single node only, even if several
+// volumes point to it. A Lease in the namespace of the controller records the node and volume holding it.
+
+package rclone
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+type writerLeases struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	driverName string
+}
+
+func newWriterLeases(kubeClient kubernetes.Interface, namespace, driverName string) *writerLeases {
+	return &writerLeases{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		driverName: driverName,
+	}
+}
+
+// errWriterConflict is returned if the remote path is already held by another node or volume
+type errWriterConflict struct {
+	path     string
+	nodeId   string
+	volumeId string
+}
+
+func (e *errWriterConflict) Error() string {
+	return fmt.Sprintf("%s is already published for writing by volume %s on node %s", e.path, e.volumeId, e.nodeId)
+}
+
+func (l *writerLeases) leaseName(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return fmt.Sprintf("%s-writer-%x", l.driverName, sum[:16])
+}
+
+func (l *writerLeases) labelKey() string {
+	return fmt.Sprintf("%s/writer", l.driverName)
+}
+
+func (l *writerLeases) volumeIdAnnotation() string {
+	return fmt.Sprintf("%s/volume-id", l.driverName)
+}
+
+func (l *writerLeases) pathAnnotation() string {
+	return fmt.Sprintf("%s/remote-path", l.driverName)
+}
+
+// acquire records nodeId and volumeId as the writer of path. Acquiring it again for the same node and volume succeeds.
+func (l *writerLeases) acquire(ctx context.Context, path, nodeId, volumeId string) error {
+	now := metav1.NewMicroTime(time.Now())
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      l.leaseName(path),
+			Namespace: l.namespace,
+			Labels:    map[string]string{l.labelKey(): "true"},
+			Annotations: map[string]string{
+				l.volumeIdAnnotation(): volumeId,
+				l.pathAnnotation():     path,
+			},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity: &nodeId,
+			AcquireTime:    &now,
+		},
+	}
+	for {
+		_, err := l.kubeClient.CoordinationV1().Leases(l.namespace).Create(ctx, lease, metav1.CreateOptions{})
+		if err == nil {
+			klog.Infof("volume %s on node %s acquired writer lease %s for %s", volumeId, nodeId, lease.Name, path)
+			return nil
+		}
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		existing, err := l.kubeClient.CoordinationV1().Leases(l.namespace).Get(ctx, lease.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// released in the meantime
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return l.conflict(existing, path, nodeId, volumeId)
+	}
+}
+
+// check returns an errWriterConflict if path is held by another node or volume than nodeId and volumeId
+func (l *writerLeases) check(ctx context.Context, path, nodeId, volumeId string) error {
+	existing, err := l.kubeClient.CoordinationV1().Leases(l.namespace).Get(ctx, l.leaseName(path), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return l.conflict(existing, path, nodeId, volumeId)
+}
+
+func (l *writerLeases) conflict(existing *coordinationv1.Lease, path, nodeId, volumeId string) error {
+	holder := ""
+	if existing.Spec.HolderIdentity != nil {
+		holder = *existing.Spec.HolderIdentity
+	}
+	if holder == nodeId && existing.Annotations[l.volumeIdAnnotation()] == volumeId {
+		return nil
+	}
+	return &errWriterConflict{path: path, nodeId: holder, volumeId: existing.Annotations[l.volumeIdAnnotation()]}
+}
+
+// release deletes the writer leases held by volumeId on nodeId, or on any node if nodeId is empty
+func (l *writerLeases) release(ctx context.Context, nodeId, volumeId string) error {
+	leases, err := l.kubeClient.CoordinationV1().Leases(l.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=true", l.labelKey()),
+	})
+	if err != nil {
+		return err
+	}
+	for _, lease := range leases.Items {
+		if lease.Annotations[l.volumeIdAnnotation()] != volumeId {
+			continue
+		}
+		if nodeId != "" && (lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != nodeId) {
+			continue
+		}
+		err := l.kubeClient.CoordinationV1().Leases(l.namespace).Delete(ctx, lease.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		klog.Infof("volume %s on node %s released writer lease %s", volumeId, nodeId, lease.Name)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package rclone
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/net/context"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestWriterLeases() (*writerLeases, *fake.Clientset) {
+	client := fake.NewSimpleClientset()
+	return newWriterLeases(client, "csi-rclone", "csi-rclone"), client
+}
+
+func TestWriterLeaseConflict(t *testing.T) {
+	ctx := context.Background()
+	leases, _ := newTestWriterLeases()
+	if err := leases.acquire(ctx, "s3:bucket/data", "node-a", "pvc-1"); err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+
+	for _, writer := range []struct{ nodeId, volumeId string }{{"node-b", "pvc-1"}, {"node-a", "pvc-2"}} {
+		err := leases.acquire(ctx, "s3:bucket/data", writer.nodeId, writer.volumeId)
+		var conflict *errWriterConflict
+		if !errors.As(err, &conflict) {
+			t.Fatalf("acquire by volume %s on %s returned %v, want a conflict", writer.volumeId, writer.nodeId, err)
+		}
+		if conflict.nodeId != "node-a" || conflict.volumeId != "pvc-1" {
+			t.Errorf("conflict names volume %s on %s, want pvc-1 on node-a", conflict.volumeId, conflict.nodeId)
+		}
+		if err := leases.check(ctx, "s3:bucket/data", writer.nodeId, writer.volumeId); !errors.As(err, &conflict) {
+			t.Errorf("check by volume %s on %s returned %v, want a conflict", writer.volumeId, writer.nodeId, err)
+		}
+	}
+
+	// other paths are not affected
+	if err := leases.acquire(ctx, "s3:bucket/other", "node-b", "pvc-2"); err != nil {
+		t.Errorf("acquire of another path failed: %v", err)
+	}
+}
+
+func TestWriterLeaseReacquire(t *testing.T) {
+	ctx := context.Background()
+	leases, _ := newTestWriterLeases()
+	for i := 0; i < 2; i++ {
+		if err := leases.acquire(ctx, "s3:bucket/data", "node-a", "pvc-1"); err != nil {
+			t.Fatalf("acquire %d by the holder failed: %v", i, err)
+		}
+	}
+	if err := leases.check(ctx, "s3:bucket/data", "node-a", "pvc-1"); err != nil {
+		t.Errorf("check by the holder failed: %v", err)
+	}
+	if err := leases.check(ctx, "s3:bucket/unused", "node-b", "pvc-2"); err != nil {
+		t.Errorf("check of a path without lease failed: %v", err)
+	}
+}
+
+func TestWriterLeaseReleasedWhileAcquiring(t *testing.T) {
+	ctx := context.Background()
+	leases, client := newTestWriterLeases()
+	// the lease exists when it is created, but is gone when it is read
+	created := false
+	client.PrependReactor("create", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if created {
+			return false, nil, nil
+		}
+		created = true
+		lease := action.(k8stesting.CreateAction).GetObject().(*coordinationv1.Lease)
+		return true, nil, apierrors.NewAlreadyExists(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, lease.Name)
+	})
+	if err := leases.acquire(ctx, "s3:bucket/data", "node-b", "pvc-1"); err != nil {
+		t.Fatalf("acquire of a lease released in the meantime failed: %v", err)
+	}
+	if err := leases.check(ctx, "s3:bucket/data", "node-b", "pvc-1"); err != nil {
+		t.Errorf("lease was not taken by node-b: %v", err)
+	}
+}
+
+func TestWriterLeaseRelease(t *testing.T) {
+	ctx := context.Background()
+	leases, client := newTestWriterLeases()
+	if err := leases.acquire(ctx, "s3:bucket/a", "node-a", "pvc-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leases.acquire(ctx, "s3:bucket/b", "node-b", "pvc-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// releasing on another node keeps the lease
+	if err := leases.release(ctx, "node-b", "pvc-1"); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if err := leases.check(ctx, "s3:bucket/a", "node-b", "pvc-3"); err == nil {
+		t.Error("lease was released by another node")
+	}
+	if err := leases.release(ctx, "node-a", "pvc-1"); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if err := leases.acquire(ctx, "s3:bucket/a", "node-b", "pvc-3"); err != nil {
+		t.Errorf("acquire after release failed: %v", err)
+	}
+
+	// a stale lease left behind on any node is released when the volume is deleted
+	if err := leases.release(ctx, "", "pvc-2"); err != nil {
+		t.Fatalf("release on any node failed: %v", err)
+	}
+	remaining, err := client.CoordinationV1().Leases("csi-rclone").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining.Items) != 1 || remaining.Items[0].Annotations[leases.volumeIdAnnotation()] != "pvc-3" {
+		t.Errorf("remaining leases = %+v, want the lease of pvc-3", remaining.Items)
+	}
+	if err := leases.release(ctx, "", "pvc-2"); err != nil {
+		t.Errorf("releasing a released lease failed: %v", err)
+	}
+}
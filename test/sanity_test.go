@@ -16,6 +16,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
@@ -40,12 +41,16 @@ func createSocketDir() (string, error) {
 	return socketDir, nil
 }
 
+// nodeId is the node the driver runs on, it is created in the cluster for the test
+const nodeId = "hostname"
+
 var _ = Describe("Sanity CSI checks", Ordered, func() {
 	var err error
-	var kubeClient *kubernetes.Clientset = &kubernetes.Clientset{}
+	var kubeClient kubernetes.Interface
 	var endpoint string
 	var driver *rclone.Driver = &rclone.Driver{}
 	var socketDir string
+	var nodeCreated bool
 
 	BeforeAll(func() {
 		socketDir, err = createSocketDir()
@@ -54,8 +59,17 @@ var _ = Describe("Sanity CSI checks", Ordered, func() {
 		kubeClient, err = kube.GetK8sClient()
 		Expect(err).ShouldNot(HaveOccurred())
 		os.Setenv("DRIVER_NAME", "csi-rclone")
-		driver = rclone.NewDriver("hostname", endpoint)
-		cs := rclone.NewControllerServer(driver.CSIDriver)
+		// ControllerPublishVolume only publishes to nodes of the cluster, the driver reports this one
+		_, err = kubeClient.CoreV1().Nodes().Create(context.Background(), &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: nodeId},
+		}, metav1.CreateOptions{})
+		nodeCreated = err == nil
+		if !apierrors.IsAlreadyExists(err) {
+			Expect(err).ShouldNot(HaveOccurred())
+		}
+		driver = rclone.NewDriver(nodeId, endpoint)
+		cs, err := rclone.NewControllerServer(driver.CSIDriver)
+		Expect(err).ShouldNot(HaveOccurred())
 		ns, err := rclone.NewNodeServer(driver.CSIDriver)
 		Expect(err).ShouldNot(HaveOccurred())
 		driver.WithControllerServer(cs).WithNodeServer(ns)
@@ -70,6 +84,9 @@ var _ = Describe("Sanity CSI checks", Ordered, func() {
 
 	AfterAll(func() {
 		driver.Stop()
+		if nodeCreated {
+			kubeClient.CoreV1().Nodes().Delete(context.Background(), nodeId, metav1.DeleteOptions{})
+		}
 		os.RemoveAll(socketDir)
 		os.Unsetenv("DRIVER_NAME")
 	})